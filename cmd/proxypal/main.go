@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
 	"github.com/luongndcoder/proxypal-nvidia/internal/config"
 	"github.com/luongndcoder/proxypal-nvidia/internal/proxy"
 )
@@ -24,11 +29,8 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	// Initialize load balancer
-	lb := balancer.NewLoadBalancer(&cfg.NVIDIA)
-
-	// Create proxy server
-	proxyServer := proxy.NewProxyServer(cfg, lb)
+	// Create proxy server with a load balancer per upstream
+	proxyServer := proxy.NewProxyServer(cfg)
 
 	// Setup Gin router
 	router := gin.Default()
@@ -40,14 +42,105 @@ func main() {
 	proxyServer.SetupRoutes(router)
 
 	// Print startup info
-	printStartupInfo(cfg, lb)
+	printStartupInfo(cfg)
+
+	// Reload configuration on SIGHUP and whenever the file changes
+	go watchConfig(configPath, proxyServer)
+
+	// Snapshot key state so a restart does not reset limits and counters
+	go proxyServer.PersistState(context.Background())
 
 	// Start server
 	addr := cfg.GetAddress()
-	log.Printf("Starting ProxyPal NVIDIA Load Balancer on %s", addr)
-	if err := router.Run(addr); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: router,
+	}
+
+	go func() {
+		log.Printf("Starting ProxyPal NVIDIA Load Balancer on %s", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// Wait for a shutdown signal, then drain in-flight requests
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	shutdown(server, proxyServer, stop)
+}
+
+// shutdown reports the server as not ready and keeps serving for the shutdown
+// delay, so load balancers see /health fail and stop sending traffic. It then
+// stops accepting connections and waits up to the drain timeout for in-flight
+// requests, including streams, before closing what is left. A second signal
+// cuts the delay short.
+func shutdown(server *http.Server, proxyServer *proxy.ProxyServer, stop <-chan os.Signal) {
+	serverCfg := proxyServer.Config().Server
+	delay := time.Duration(serverCfg.ShutdownDelay) * time.Second
+	drainTimeout := time.Duration(serverCfg.DrainTimeout) * time.Second
+
+	proxyServer.StartDraining()
+
+	log.Printf("Shutting down, still serving for %s while /health reports draining", delay)
+	select {
+	case <-time.After(delay):
+	case <-stop:
+	}
+
+	log.Printf("Closing listeners, draining %d in-flight requests (timeout %s)", proxyServer.InFlight(), drainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Drain timeout reached with %d requests in flight, closing connections", proxyServer.InFlight())
+		server.Close()
 	}
+
+	if err := proxyServer.SaveState(); err != nil {
+		log.Printf("Failed to save key state: %v", err)
+	}
+
+	log.Printf("Server stopped")
+}
+
+// configPollInterval is how often the configuration file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// watchConfig reloads the configuration on SIGHUP and on file changes
+func watchConfig(configPath string, proxyServer *proxy.ProxyServer) {
+	go config.Watch(context.Background(), configPath, configPollInterval, func() {
+		reloadConfig(configPath, proxyServer)
+	})
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloadConfig(configPath, proxyServer)
+	}
+}
+
+// reloadConfig loads and applies the configuration file, keeping the current
+// configuration when the new one is invalid
+func reloadConfig(configPath string, proxyServer *proxy.ProxyServer) {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Printf("Keeping current configuration: %v", err)
+		return
+	}
+
+	if cfg.GetAddress() != proxyServer.Config().GetAddress() {
+		log.Printf("Server address change to %s requires a restart", cfg.GetAddress())
+	}
+
+	if err := proxyServer.Reload(cfg); err != nil {
+		log.Printf("Keeping current configuration: %v", err)
+		return
+	}
+	log.Printf("Configuration reloaded from %s", configPath)
 }
 
 // getConfigPath returns the configuration file path
@@ -77,23 +170,33 @@ func corsMiddleware() gin.HandlerFunc {
 }
 
 // printStartupInfo prints startup information
-func printStartupInfo(cfg *config.Config, lb *balancer.LoadBalancer) {
-	stats := lb.GetStats()
-
+func printStartupInfo(cfg *config.Config) {
 	banner := "============================================================"
 	fmt.Println("\n" + banner)
 	fmt.Println("  ProxyPal NVIDIA Load Balancer")
 	fmt.Println(banner)
 	fmt.Printf("  Server Address: http://%s\n", cfg.GetAddress())
-	fmt.Printf("  API Keys: %d\n", len(stats))
-	fmt.Printf("  Rate Limit: %d requests/minute per key\n", cfg.NVIDIA.RateLimit)
-	fmt.Printf("  Total Capacity: ~%d requests/minute\n", cfg.NVIDIA.RateLimit*len(stats))
+	for _, upstream := range cfg.GetUpstreams() {
+		fmt.Printf("  Upstream %s: %s\n", upstream.Name, upstream.BaseURL)
+		keys := upstream.KeyConfigs()
+		capacity := 0
+		for _, key := range keys {
+			capacity += key.RateLimit
+		}
+		fmt.Printf("    API Keys: %d\n", len(keys))
+		fmt.Printf("    Rate Limit: %d requests/minute per key\n", upstream.RateLimit)
+		fmt.Printf("    Total Capacity: ~%d requests/minute\n", capacity)
+	}
+	if len(cfg.Routes) > 0 {
+		fmt.Printf("  Model Routes: %d\n", len(cfg.Routes))
+	}
 	fmt.Println(banner)
 	fmt.Println("\n  Endpoints:")
 	fmt.Printf("    POST   /v1/chat/completions   - OpenAI-compatible chat completions\n")
 	fmt.Printf("    GET    /v1/models             - List available models\n")
 	fmt.Printf("    GET    /health                - Health check\n")
 	fmt.Printf("    GET    /stats                 - Load balancer statistics\n")
+	fmt.Printf("    GET    /metrics               - Prometheus metrics\n")
 	fmt.Println("\n" + banner)
 	fmt.Println()
 }
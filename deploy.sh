@@ -81,6 +81,6 @@ echo "  Check status:   $COMPOSE_CMD ps"
 echo ""
 echo "🧪 Test the service:"
 echo "  curl http://localhost:8080/health"
-echo "  curl http://localhost:8080/stats"
+echo "  curl http://localhost:8080/stats -H \"X-Admin-Token: \$ADMIN_TOKEN\""
 echo ""
 echo "Happy load balancing! 🚀"
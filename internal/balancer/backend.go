@@ -0,0 +1,39 @@
+package balancer
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimiterBackend keeps request buckets outside the process, e.g. in a
+// store shared by every proxy replica so together they stay within each
+// key's rate limit. Buckets refill continuously at limit tokens per minute
+// up to limit.
+type RateLimiterBackend interface {
+	// Take removes n tokens from every bucket when each of them holds
+	// enough, so a request counts against all of them or none, and reports
+	// the buckets in order. With n set to 0 it only reports them.
+	Take(ctx context.Context, buckets []Bucket, n int) ([]BucketState, error)
+	// Set overrides the tokens in the bucket, refilling from the given time
+	// on, e.g. to pause it until upstream's reset time
+	Set(ctx context.Context, bucket string, tokens int, from time.Time) error
+}
+
+// Bucket names a shared bucket and the tokens it refills per minute
+type Bucket struct {
+	Name  string
+	Limit int
+}
+
+// BucketState is the outcome of taking tokens from a shared bucket
+type BucketState struct {
+	// Allowed reports whether the tokens were taken from every bucket
+	Allowed   bool
+	Remaining int
+	// Wait is how long until the next token, 0 when one is available
+	Wait time.Duration
+}
+
+// sharedTimeout bounds every call to a shared backend so an unresponsive
+// store falls back to local limiting quickly
+const sharedTimeout = 250 * time.Millisecond
@@ -0,0 +1,168 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a key's circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through normally
+	CircuitClosed CircuitState = iota
+	// CircuitOpen keeps the key out of rotation until the cooldown expires
+	CircuitOpen
+	// CircuitHalfOpen lets a single trial request through
+	CircuitHalfOpen
+)
+
+// String returns the state name used in stats output
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker takes a failing API key out of rotation after a number of
+// consecutive failures and probes it back in after a cooldown
+type CircuitBreaker struct {
+	state        CircuitState
+	failures     int
+	threshold    int
+	cooldown     time.Duration
+	openedAt     time.Time
+	probeStarted time.Time
+	probing      bool
+	mu           sync.Mutex
+}
+
+// NewCircuitBreaker creates a circuit breaker. A threshold of zero or less
+// disables the breaker so it always stays closed.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		state:     CircuitClosed,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Configure changes the failure threshold and cooldown, keeping the current
+// state. A threshold of zero or less closes the circuit for good.
+func (cb *CircuitBreaker) Configure(threshold int, cooldown time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.threshold = threshold
+	cb.cooldown = cooldown
+	if threshold <= 0 {
+		cb.state = CircuitClosed
+		cb.failures = 0
+		cb.probing = false
+	}
+}
+
+// Allow reports whether a request may be sent with the key. In the half-open
+// state only one caller is allowed through until the trial is recorded.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+
+	switch cb.state {
+	case CircuitOpen:
+		if now.Sub(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = CircuitHalfOpen
+		cb.startProbe(now)
+		return true
+	case CircuitHalfOpen:
+		// A trial whose outcome was never recorded should not pin the key
+		// out of rotation forever
+		if cb.probing && now.Sub(cb.probeStarted) < cb.cooldown {
+			return false
+		}
+		cb.startProbe(now)
+		return true
+	default:
+		return true
+	}
+}
+
+// Cancel releases a trial slot obtained from Allow that was not used
+func (cb *CircuitBreaker) Cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitHalfOpen {
+		cb.probing = false
+	}
+}
+
+// RecordSuccess closes the circuit and resets the failure count
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = CircuitClosed
+	cb.failures = 0
+	cb.probing = false
+}
+
+// RecordFailure counts a failure and opens the circuit once the threshold is
+// reached. A failed trial in the half-open state reopens it immediately.
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.failures++
+	cb.probing = false
+
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.threshold {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// RetryIn returns how long until Allow may let a request through again, 0
+// when it may now
+func (cb *CircuitBreaker) RetryIn() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	var since time.Time
+	switch {
+	case cb.state == CircuitOpen:
+		since = cb.openedAt
+	case cb.state == CircuitHalfOpen && cb.probing:
+		since = cb.probeStarted
+	default:
+		return 0
+	}
+	return max(cb.cooldown-time.Since(since), 0)
+}
+
+// State returns the current circuit state
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
+}
+
+// startProbe marks a trial request as in flight
+func (cb *CircuitBreaker) startProbe(now time.Time) {
+	cb.probing = true
+	cb.probeStarted = now
+}
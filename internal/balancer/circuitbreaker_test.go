@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_OpensAfterThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		cb.RecordFailure()
+	}
+	if cb.State() != CircuitClosed {
+		t.Errorf("Expected closed circuit below threshold, got %s", cb.State())
+	}
+
+	cb.RecordFailure()
+	if cb.State() != CircuitOpen {
+		t.Errorf("Expected open circuit at threshold, got %s", cb.State())
+	}
+
+	if cb.Allow() {
+		t.Error("Open circuit should not allow requests during cooldown")
+	}
+}
+
+func TestCircuitBreaker_SuccessResetsFailures(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute)
+
+	cb.RecordFailure()
+	cb.RecordSuccess()
+	cb.RecordFailure()
+
+	if cb.State() != CircuitClosed {
+		t.Errorf("Expected failures to be consecutive, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreaker_HalfOpenSingleTrial(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Minute)
+	cb.RecordFailure()
+
+	// Pretend the cooldown has elapsed
+	cb.openedAt = time.Now().Add(-2 * time.Minute)
+
+	if !cb.Allow() {
+		t.Fatal("Expected a trial request after cooldown")
+	}
+	if cb.State() != CircuitHalfOpen {
+		t.Errorf("Expected half-open circuit, got %s", cb.State())
+	}
+	if cb.Allow() {
+		t.Error("Only one trial request should be allowed while half-open")
+	}
+
+	cb.RecordSuccess()
+	if cb.State() != CircuitClosed {
+		t.Errorf("Expected successful trial to close the circuit, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreaker_FailedTrialReopens(t *testing.T) {
+	cb := NewCircuitBreaker(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		cb.RecordFailure()
+	}
+	cb.openedAt = time.Now().Add(-2 * time.Minute)
+
+	if !cb.Allow() {
+		t.Fatal("Expected a trial request after cooldown")
+	}
+	cb.RecordFailure()
+
+	if cb.State() != CircuitOpen {
+		t.Errorf("Expected failed trial to reopen the circuit, got %s", cb.State())
+	}
+	if cb.Allow() {
+		t.Error("Reopened circuit should wait for a new cooldown")
+	}
+}
+
+func TestCircuitBreaker_RetryIn(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Minute)
+	if wait := cb.RetryIn(); wait != 0 {
+		t.Errorf("Expected a closed circuit to allow requests now, got %v", wait)
+	}
+
+	cb.RecordFailure()
+	cb.openedAt = time.Now().Add(-40 * time.Second)
+	if wait := cb.RetryIn(); wait <= 19*time.Second || wait > 20*time.Second {
+		t.Errorf("Expected to wait out the last 20s of the cooldown, got %v", wait)
+	}
+}
+
+func TestCircuitBreaker_Cancel(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Minute)
+	cb.RecordFailure()
+	cb.openedAt = time.Now().Add(-2 * time.Minute)
+
+	if !cb.Allow() {
+		t.Fatal("Expected a trial request after cooldown")
+	}
+	cb.Cancel()
+
+	if !cb.Allow() {
+		t.Error("Cancelled trial slot should be available again")
+	}
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	cb := NewCircuitBreaker(0, 0)
+
+	for i := 0; i < 100; i++ {
+		cb.RecordFailure()
+	}
+
+	if !cb.Allow() {
+		t.Error("Disabled circuit breaker should always allow requests")
+	}
+}
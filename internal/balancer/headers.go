@@ -0,0 +1,86 @@
+package balancer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpstreamLimits is the rate limit state reported in upstream response headers
+type UpstreamLimits struct {
+	RetryAfter   time.Duration // zero when the header is absent
+	Remaining    int
+	HasRemaining bool
+	Reset        time.Duration // time until the remaining quota resets
+}
+
+// remainingHeaders and resetHeaders are checked in order; the first one
+// present wins
+var (
+	remainingHeaders = []string{"X-Ratelimit-Remaining-Requests", "X-Ratelimit-Remaining"}
+	resetHeaders     = []string{"X-Ratelimit-Reset-Requests", "X-Ratelimit-Reset"}
+)
+
+// ParseUpstreamLimits reads Retry-After and x-ratelimit-* headers
+func ParseUpstreamLimits(h http.Header, now time.Time) UpstreamLimits {
+	var limits UpstreamLimits
+
+	if v := h.Get("Retry-After"); v != "" {
+		limits.RetryAfter = parseRetryAfter(v, now)
+	}
+
+	for _, name := range remainingHeaders {
+		if v := h.Get(name); v != "" {
+			if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				limits.Remaining = n
+				limits.HasRemaining = true
+			}
+			break
+		}
+	}
+
+	for _, name := range resetHeaders {
+		if v := h.Get(name); v != "" {
+			limits.Reset = parseReset(v, now)
+			break
+		}
+	}
+
+	return limits
+}
+
+// parseRetryAfter accepts either delay-seconds or an HTTP-date
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return nonNegative(time.Duration(secs * float64(time.Second)))
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return nonNegative(t.Sub(now))
+	}
+	return 0
+}
+
+// parseReset accepts a Go-style duration ("1s", "6m0s"), seconds, or a unix timestamp
+func parseReset(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if d, err := time.ParseDuration(v); err == nil {
+		return nonNegative(d)
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		// Values this large can only be absolute epoch timestamps
+		if secs > 1e9 {
+			return nonNegative(time.Unix(int64(secs), 0).Sub(now))
+		}
+		return nonNegative(time.Duration(secs * float64(time.Second)))
+	}
+	return 0
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
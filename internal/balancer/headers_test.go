@@ -0,0 +1,75 @@
+package balancer
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreamLimits(t *testing.T) {
+	now := time.Date(2024, 1, 8, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected UpstreamLimits
+	}{
+		{
+			name:     "no headers",
+			headers:  map[string]string{},
+			expected: UpstreamLimits{},
+		},
+		{
+			name:     "retry-after seconds",
+			headers:  map[string]string{"Retry-After": "12"},
+			expected: UpstreamLimits{RetryAfter: 12 * time.Second},
+		},
+		{
+			name:     "retry-after http date",
+			headers:  map[string]string{"Retry-After": now.Add(30 * time.Second).Format(http.TimeFormat)},
+			expected: UpstreamLimits{RetryAfter: 30 * time.Second},
+		},
+		{
+			name: "openai style remaining and reset",
+			headers: map[string]string{
+				"x-ratelimit-remaining-requests": "17",
+				"x-ratelimit-reset-requests":     "6m0s",
+			},
+			expected: UpstreamLimits{Remaining: 17, HasRemaining: true, Reset: 6 * time.Minute},
+		},
+		{
+			name: "generic remaining with seconds reset",
+			headers: map[string]string{
+				"x-ratelimit-remaining": "0",
+				"x-ratelimit-reset":     "20",
+			},
+			expected: UpstreamLimits{Remaining: 0, HasRemaining: true, Reset: 20 * time.Second},
+		},
+		{
+			name: "epoch reset",
+			headers: map[string]string{
+				"x-ratelimit-remaining": "3",
+				"x-ratelimit-reset":     "1704708045",
+			},
+			expected: UpstreamLimits{Remaining: 3, HasRemaining: true, Reset: 45 * time.Second},
+		},
+		{
+			name:     "garbage is ignored",
+			headers:  map[string]string{"Retry-After": "soon", "x-ratelimit-remaining": "many"},
+			expected: UpstreamLimits{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+
+			if got := ParseUpstreamLimits(h, now); got != tt.expected {
+				t.Errorf("ParseUpstreamLimits() = %+v, expected %+v", got, tt.expected)
+			}
+		})
+	}
+}
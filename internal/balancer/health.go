@@ -0,0 +1,106 @@
+package balancer
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// healthAlpha is the weight of the newest observation in the moving averages
+	healthAlpha = 0.2
+
+	// healthHalfLife is how long it takes an idle key's error rate to halve,
+	// so a key that had a bad spell gets another chance
+	healthHalfLife = time.Minute
+
+	// defaultTTFB is the time to first byte assumed for unmeasured keys while
+	// no key has been measured
+	defaultTTFB = time.Second
+
+	// maxErrorRate caps the error rate used for scoring so a failing key
+	// scores high rather than infinite
+	maxErrorRate = 0.95
+)
+
+// KeyHealth tracks exponentially weighted moving averages of how fast an API
+// key's upstream starts responding and how often its requests fail
+type KeyHealth struct {
+	ttfb      float64 // seconds, 0 until the first observation
+	errorRate float64
+	updated   time.Time // of the error rate
+	mu        sync.Mutex
+}
+
+// NewKeyHealth creates a health tracker with no observations
+func NewKeyHealth() *KeyHealth {
+	return &KeyHealth{}
+}
+
+// ObserveTTFB records how long the upstream took to return headers
+func (h *KeyHealth) ObserveTTFB(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.ttfb == 0 {
+		h.ttfb = d.Seconds()
+		return
+	}
+	h.ttfb += healthAlpha * (d.Seconds() - h.ttfb)
+}
+
+// ObserveOutcome records whether a request failed
+func (h *KeyHealth) ObserveOutcome(failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sample := 0.0
+	if failed {
+		sample = 1
+	}
+	now := time.Now()
+	current := h.decayedErrorRate(now)
+	h.errorRate = current + healthAlpha*(sample-current)
+	h.updated = now
+}
+
+// TTFB returns the average time to first byte, 0 without observations
+func (h *KeyHealth) TTFB() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return time.Duration(h.ttfb * float64(time.Second))
+}
+
+// ErrorRate returns the average share of failed requests between 0 and 1
+func (h *KeyHealth) ErrorRate() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.decayedErrorRate(time.Now())
+}
+
+// Score estimates the seconds until a request on the key gets a successful
+// response, counting failed attempts as retries. Lower is better. A key whose
+// time to first byte was never measured, such as one failing before any
+// response, is assumed to take the prior.
+func (h *KeyHealth) Score(prior time.Duration) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ttfb := h.ttfb
+	if ttfb == 0 {
+		ttfb = prior.Seconds()
+	}
+	return ttfb / (1 - math.Min(h.decayedErrorRate(time.Now()), maxErrorRate))
+}
+
+// decayedErrorRate fades the error rate towards 0 while the key is not used.
+// Must be called with the lock held.
+func (h *KeyHealth) decayedErrorRate(now time.Time) float64 {
+	if h.errorRate == 0 {
+		return 0
+	}
+	idle := now.Sub(h.updated)
+	return h.errorRate * math.Exp2(-idle.Seconds()/healthHalfLife.Seconds())
+}
@@ -0,0 +1,45 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyHealth_MovingAverages(t *testing.T) {
+	h := NewKeyHealth()
+
+	if score := h.Score(time.Second); score != 1 {
+		t.Errorf("Expected the prior as score without observations, got %f", score)
+	}
+
+	// The first sample seeds the average, later ones move it by healthAlpha
+	h.ObserveTTFB(100 * time.Millisecond)
+	h.ObserveTTFB(600 * time.Millisecond)
+	if ttfb := h.TTFB(); ttfb < 199*time.Millisecond || ttfb > 201*time.Millisecond {
+		t.Errorf("Expected TTFB around 200ms, got %v", ttfb)
+	}
+
+	h.ObserveOutcome(true)
+	if rate := h.ErrorRate(); rate < 0.19 || rate > 0.2 {
+		t.Errorf("Expected error rate around 0.2, got %f", rate)
+	}
+
+	// Failures make the expected time to a successful response longer
+	if score := h.Score(time.Second); score <= h.TTFB().Seconds() {
+		t.Errorf("Expected score above the TTFB with errors, got %f", score)
+	}
+}
+
+func TestKeyHealth_ErrorRateDecays(t *testing.T) {
+	h := NewKeyHealth()
+	h.ObserveOutcome(true)
+
+	// Pretend the failure happened one half-life ago
+	h.mu.Lock()
+	h.updated = h.updated.Add(-healthHalfLife)
+	h.mu.Unlock()
+
+	if rate := h.ErrorRate(); rate < 0.099 || rate > 0.101 {
+		t.Errorf("Expected error rate to halve to 0.1, got %f", rate)
+	}
+}
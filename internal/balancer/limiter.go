@@ -0,0 +1,276 @@
+package balancer
+
+import (
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// Clock returns the current time. Limiters take one so tests can control time.
+type Clock func() time.Time
+
+// Limiter is an algorithm limiting requests to a number per minute.
+// Implementations are not safe for concurrent use; RateLimiter guards them.
+type Limiter interface {
+	// TryAcquire takes a request, reporting whether one was available
+	TryAcquire() bool
+	// Refund gives back a request from TryAcquire that went unused
+	Refund()
+	// Available returns how many requests may be taken right now
+	Available() int
+	// Wait returns how long until a request may be taken, 0 when one may now
+	Wait() time.Duration
+	// SetLimit changes the requests per minute and the burst, which must
+	// be positive
+	SetLimit(limit, burst int)
+	// Reset sets the requests available as of the given time, e.g. to what
+	// upstream reported
+	Reset(available int, at time.Time)
+}
+
+// NewLimiter creates a limiter using the named algorithm, a token bucket by
+// default. A burst of 0 allows as many requests at once as the limit.
+func NewLimiter(algorithm string, limit, burst int, clock Clock) Limiter {
+	burst = burstFor(limit, burst)
+
+	switch algorithm {
+	case config.LimiterSlidingWindow:
+		return &slidingWindow{limit: limit, clock: clock}
+	case config.LimiterGCRA:
+		return &gcra{interval: limitInterval(limit), burst: burst, tat: clock(), clock: clock}
+	default:
+		return &tokenBucket{
+			units: int64(burst) * int64(time.Minute),
+			limit: limit,
+			burst: burst,
+			last:  clock(),
+			clock: clock,
+		}
+	}
+}
+
+// burstFor returns the burst to use for a limit, the limit itself for 0
+func burstFor(limit, burst int) int {
+	if burst <= 0 {
+		return limit
+	}
+	return burst
+}
+
+// limitInterval returns the time between requests at the limit
+func limitInterval(limit int) time.Duration {
+	if limit <= 0 {
+		return time.Minute
+	}
+	return time.Minute / time.Duration(limit)
+}
+
+// tokenBucket refills continuously, one request every minute/limit, and holds
+// at most burst requests. A request is worth a minute of units and every
+// nanosecond adds limit units, so refilling never loses a fraction.
+type tokenBucket struct {
+	units int64
+	limit int
+	burst int
+	last  time.Time // of the last refill
+	clock Clock
+}
+
+func (tb *tokenBucket) TryAcquire() bool {
+	tb.refill(tb.clock())
+	if tb.units < int64(time.Minute) {
+		return false
+	}
+	tb.units -= int64(time.Minute)
+	return true
+}
+
+func (tb *tokenBucket) Refund() {
+	tb.units = min(tb.units+int64(time.Minute), tb.capacity())
+}
+
+func (tb *tokenBucket) Available() int {
+	tb.refill(tb.clock())
+	return int(tb.units / int64(time.Minute))
+}
+
+func (tb *tokenBucket) Wait() time.Duration {
+	now := tb.clock()
+	tb.refill(now)
+	missing := int64(time.Minute) - tb.units
+	if missing <= 0 {
+		return 0
+	}
+	if tb.limit <= 0 {
+		return time.Minute
+	}
+	// Refilling starts once a reset to a time to come is reached. Round up so
+	// the request is really there once the wait is over.
+	return max(tb.last.Sub(now), 0) + time.Duration((missing+int64(tb.limit)-1)/int64(tb.limit))
+}
+
+// SetLimit keeps the requests already in the bucket, up to the new burst
+func (tb *tokenBucket) SetLimit(limit, burst int) {
+	tb.refill(tb.clock())
+	tb.limit, tb.burst = limit, burst
+	tb.units = min(tb.units, tb.capacity())
+}
+
+func (tb *tokenBucket) Reset(available int, at time.Time) {
+	tb.units = min(int64(max(available, 0))*int64(time.Minute), tb.capacity())
+	tb.last = at
+}
+
+// refill adds the units accrued since the last refill
+func (tb *tokenBucket) refill(now time.Time) {
+	if !now.After(tb.last) {
+		return
+	}
+
+	// An empty bucket is full again after burst intervals, so capping there
+	// keeps elapsed * limit from overflowing
+	elapsed := min(now.Sub(tb.last), time.Duration(tb.burst+1)*limitInterval(tb.limit))
+	tb.units = min(tb.units+int64(elapsed)*int64(tb.limit), tb.capacity())
+	tb.last = now
+}
+
+// capacity returns the units of a full bucket
+func (tb *tokenBucket) capacity() int64 {
+	return int64(tb.burst) * int64(time.Minute)
+}
+
+// slidingWindow allows at most limit requests in any minute, keeping the time
+// of every request of the last minute. It has no burst of its own: the whole
+// limit may be used at once.
+type slidingWindow struct {
+	log   []time.Time // oldest first
+	limit int
+	clock Clock
+}
+
+func (sw *slidingWindow) TryAcquire() bool {
+	now := sw.clock()
+	sw.prune(now)
+	if len(sw.log) >= sw.limit {
+		return false
+	}
+	sw.log = append(sw.log, now)
+	return true
+}
+
+func (sw *slidingWindow) Refund() {
+	if len(sw.log) > 0 {
+		sw.log = sw.log[:len(sw.log)-1]
+	}
+}
+
+func (sw *slidingWindow) Available() int {
+	sw.prune(sw.clock())
+	return max(sw.limit-len(sw.log), 0)
+}
+
+func (sw *slidingWindow) Wait() time.Duration {
+	now := sw.clock()
+	sw.prune(now)
+	if len(sw.log) < sw.limit {
+		return 0
+	}
+	if sw.limit <= 0 {
+		return time.Minute
+	}
+	// Enough requests must leave the window to get below the limit
+	return sw.log[len(sw.log)-sw.limit].Add(time.Minute).Sub(now)
+}
+
+// SetLimit keeps the requests already in the window. The burst does not apply.
+func (sw *slidingWindow) SetLimit(limit, _ int) {
+	sw.limit = limit
+}
+
+// Reset spreads the used requests evenly over the minute up to at, as
+// steady traffic would have, so they leave the window one by one
+func (sw *slidingWindow) Reset(available int, at time.Time) {
+	used := sw.limit - min(max(available, 0), sw.limit)
+	interval := limitInterval(sw.limit)
+
+	sw.log = sw.log[:0]
+	for i := used; i > 0; i-- {
+		sw.log = append(sw.log, at.Add(-time.Duration(i-1)*interval))
+	}
+}
+
+// prune drops the requests that left the window
+func (sw *slidingWindow) prune(now time.Time) {
+	start := now.Add(-time.Minute)
+	expired := 0
+	for expired < len(sw.log) && !sw.log[expired].After(start) {
+		expired++
+	}
+	// Appending moves the log to a new array once the old one is used up,
+	// which leaves the expired requests behind
+	sw.log = sw.log[expired:]
+}
+
+// gcra is the generic cell rate algorithm: it tracks the theoretical arrival
+// time of the next request, which moves one interval ahead per request, and
+// allows a request while that time is less than burst-1 intervals ahead.
+// It behaves like a token bucket but keeps a single timestamp.
+type gcra struct {
+	tat      time.Time
+	interval time.Duration
+	burst    int
+	clock    Clock
+}
+
+func (g *gcra) TryAcquire() bool {
+	now := g.clock()
+	tat := g.arrival(now)
+	if tat.Sub(now) > g.tolerance() {
+		return false
+	}
+	g.tat = tat.Add(g.interval)
+	return true
+}
+
+func (g *gcra) Refund() {
+	g.tat = g.tat.Add(-g.interval)
+}
+
+func (g *gcra) Available() int {
+	now := g.clock()
+	ahead := g.arrival(now).Sub(now)
+	if ahead > g.tolerance() {
+		return 0
+	}
+	return int((g.tolerance()-ahead)/g.interval) + 1
+}
+
+func (g *gcra) Wait() time.Duration {
+	now := g.clock()
+	return max(g.arrival(now).Sub(now)-g.tolerance(), 0)
+}
+
+// SetLimit keeps the requests available, up to the new burst
+func (g *gcra) SetLimit(limit, burst int) {
+	available := g.Available()
+	g.interval, g.burst = limitInterval(limit), burst
+	g.Reset(available, g.clock())
+}
+
+func (g *gcra) Reset(available int, at time.Time) {
+	used := g.burst - min(max(available, 0), g.burst)
+	g.tat = at.Add(time.Duration(used) * g.interval)
+}
+
+// arrival returns when the next request is due, never before now
+func (g *gcra) arrival(now time.Time) time.Time {
+	if g.tat.Before(now) {
+		return now
+	}
+	return g.tat
+}
+
+// tolerance is how far ahead of now the next request may be due
+func (g *gcra) tolerance() time.Duration {
+	return time.Duration(g.burst-1) * g.interval
+}
@@ -0,0 +1,255 @@
+package balancer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var limiterAlgorithms = []string{config.LimiterTokenBucket, config.LimiterSlidingWindow, config.LimiterGCRA}
+
+// acquireAll takes requests until the limiter refuses one
+func acquireAll(l Limiter) int {
+	n := 0
+	for l.TryAcquire() {
+		n++
+	}
+	return n
+}
+
+func TestLimiters_Limit(t *testing.T) {
+	for _, algorithm := range limiterAlgorithms {
+		clock := newFakeClock()
+		l := NewLimiter(algorithm, 60, 0, clock.Now)
+
+		if got := l.Available(); got != 60 {
+			t.Errorf("%s: Expected 60 available, got %d", algorithm, got)
+		}
+		if got := acquireAll(l); got != 60 {
+			t.Errorf("%s: Expected 60 requests at once, got %d", algorithm, got)
+		}
+		if l.Wait() <= 0 {
+			t.Errorf("%s: Expected to wait once drained", algorithm)
+		}
+
+		// An hour later the whole limit is back, and not more
+		clock.Advance(time.Hour)
+		if got := acquireAll(l); got != 60 {
+			t.Errorf("%s: Expected 60 requests after an hour, got %d", algorithm, got)
+		}
+	}
+}
+
+func TestLimiters_Refund(t *testing.T) {
+	for _, algorithm := range limiterAlgorithms {
+		clock := newFakeClock()
+		l := NewLimiter(algorithm, 10, 0, clock.Now)
+
+		acquireAll(l)
+		l.Refund()
+		if got := l.Available(); got != 1 {
+			t.Errorf("%s: Expected the refunded request to be available, got %d", algorithm, got)
+		}
+	}
+}
+
+func TestLimiters_Reset(t *testing.T) {
+	for _, algorithm := range limiterAlgorithms {
+		clock := newFakeClock()
+		l := NewLimiter(algorithm, 60, 0, clock.Now)
+
+		l.Reset(5, clock.Now())
+		if got := l.Available(); got != 5 {
+			t.Errorf("%s: Expected 5 available after reset, got %d", algorithm, got)
+		}
+
+		l.Reset(100, clock.Now())
+		if got := l.Available(); got != 60 {
+			t.Errorf("%s: Expected reset capped at 60, got %d", algorithm, got)
+		}
+
+		// Drained as of a time to come, requests come back one by one from then
+		l.Reset(0, clock.Now().Add(30*time.Second))
+		if wait := l.Wait(); wait != 31*time.Second {
+			t.Errorf("%s: Expected to wait 31s, got %v", algorithm, wait)
+		}
+		clock.Advance(32 * time.Second)
+		if got := l.Available(); got != 2 {
+			t.Errorf("%s: Expected 2 available, got %d", algorithm, got)
+		}
+	}
+}
+
+func TestTokenBucket_SmoothRefill(t *testing.T) {
+	clock := newFakeClock()
+	l := NewLimiter(config.LimiterTokenBucket, 40, 0, clock.Now)
+	acquireAll(l)
+
+	// 40 per minute is one every 1.5s, and fractions of a token add up
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Second)
+	}
+	if got := l.Available(); got != 2 {
+		t.Errorf("Expected 2 tokens after 3s, got %d", got)
+	}
+	acquireAll(l)
+	if wait := l.Wait(); wait != 1500*time.Millisecond {
+		t.Errorf("Expected to wait 1.5s, got %v", wait)
+	}
+}
+
+func TestTokenBucket_Burst(t *testing.T) {
+	clock := newFakeClock()
+	l := NewLimiter(config.LimiterTokenBucket, 60, 5, clock.Now)
+
+	if got := acquireAll(l); got != 5 {
+		t.Errorf("Expected a burst of 5, got %d", got)
+	}
+	clock.Advance(time.Minute)
+	if got := l.Available(); got != 5 {
+		t.Errorf("Expected the bucket to hold at most 5, got %d", got)
+	}
+
+	l.SetLimit(60, 2)
+	if got := l.Available(); got != 2 {
+		t.Errorf("Expected tokens capped at the new burst, got %d", got)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	clock := newFakeClock()
+	l := NewLimiter(config.LimiterSlidingWindow, 3, 0, clock.Now)
+
+	for i := 0; i < 3; i++ {
+		if !l.TryAcquire() {
+			t.Errorf("Failed to acquire request %d", i+1)
+		}
+		clock.Advance(20 * time.Second)
+	}
+	if got := l.Available(); got != 1 {
+		t.Errorf("Expected the first request to have left the window, got %d available", got)
+	}
+	if !l.TryAcquire() {
+		t.Error("Failed to acquire request once the first left the window")
+	}
+
+	// The second request leaves the window a minute after it was made, not
+	// when the whole window is over as with a fixed window
+	clock.Advance(10 * time.Second)
+	if l.TryAcquire() {
+		t.Error("Should not acquire a fifth request within the minute")
+	}
+	if wait := l.Wait(); wait != 10*time.Second {
+		t.Errorf("Expected to wait 10s, got %v", wait)
+	}
+	clock.Advance(10 * time.Second)
+	if !l.TryAcquire() {
+		t.Error("Failed to acquire request once the second left the window")
+	}
+
+	// Lowering the limit keeps the requests already in the window
+	l.SetLimit(2, 0)
+	if got := l.Available(); got != 0 {
+		t.Errorf("Expected 0 available, got %d", got)
+	}
+}
+
+func TestGCRA(t *testing.T) {
+	clock := newFakeClock()
+	l := NewLimiter(config.LimiterGCRA, 60, 3, clock.Now)
+
+	if got := acquireAll(l); got != 3 {
+		t.Errorf("Expected a burst of 3, got %d", got)
+	}
+	if wait := l.Wait(); wait != time.Second {
+		t.Errorf("Expected to wait 1s, got %v", wait)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	if got := l.Available(); got != 1 {
+		t.Errorf("Expected 1 available, got %d", got)
+	}
+	if !l.TryAcquire() || l.TryAcquire() {
+		t.Error("Expected exactly one request to be allowed")
+	}
+	if wait := l.Wait(); wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %v", wait)
+	}
+
+	// Raising the limit keeps the requests available
+	l.SetLimit(120, 6)
+	if got := l.Available(); got != 0 {
+		t.Errorf("Expected 0 available, got %d", got)
+	}
+	if wait := l.Wait(); wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms at the new limit, got %v", wait)
+	}
+}
+
+func TestRateLimiter_Configure(t *testing.T) {
+	clock := newFakeClock()
+	rl := newRateLimiter(config.LimiterTokenBucket, 10, 0, clock.Now)
+	for i := 0; i < 4; i++ {
+		rl.TryAcquire()
+	}
+
+	// Switching algorithm keeps the requests available
+	rl.configure(config.LimiterGCRA, 10, 0)
+	if got := rl.AvailableTokens(); got != 6 {
+		t.Errorf("Expected 6 tokens after switching to GCRA, got %d", got)
+	}
+	rl.configure(config.LimiterSlidingWindow, 10, 0)
+	if got := rl.AvailableTokens(); got != 6 {
+		t.Errorf("Expected 6 tokens after switching to a sliding window, got %d", got)
+	}
+}
+
+func BenchmarkLimiter(b *testing.B) {
+	for _, algorithm := range limiterAlgorithms {
+		b.Run(algorithm, func(b *testing.B) {
+			clock := newFakeClock()
+			l := NewLimiter(algorithm, 6000, 0, clock.Now)
+			for i := 0; i < b.N; i++ {
+				clock.Advance(5 * time.Millisecond)
+				l.TryAcquire()
+			}
+		})
+	}
+}
+
+func BenchmarkRateLimiter_Parallel(b *testing.B) {
+	for _, algorithm := range limiterAlgorithms {
+		b.Run(algorithm, func(b *testing.B) {
+			rl := newRateLimiter(algorithm, 6000, 0, time.Now)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rl.TryAcquire()
+				}
+			})
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package balancer
 
 import (
+	"container/list"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -13,98 +14,565 @@ import (
 type APIKey struct {
 	Key          string
 	RateLimiter  *RateLimiter
+	TokenLimiter *TokenLimiter
+	Quota        *Quota
+	Breaker      *CircuitBreaker
+	Health       *KeyHealth
 	LastUsed     time.Time
 	RequestCount atomic.Uint64
 	ErrorCount   atomic.Uint64
+
+	// Tokens reported by the upstream for requests made with the key
+	PromptTokens     atomic.Uint64
+	CompletionTokens atomic.Uint64
+
+	// Share of requests under weighted round-robin and the priority under
+	// tiered selection, lower tiers first
+	Weight int
+	Tier   int
+
+	currentWeight int // smooth weighted round-robin state
+
+	config        config.KeyConfig
+	modelLimiters map[string]*RateLimiter // per model limit pattern, created on first use
+
+	inFlight  atomic.Int64 // handed out and not yet released
+	forbidden atomic.Int64 // 403s from the upstream since the last success
+
+	disabled       bool
+	disabledReason string
+	disabledAt     time.Time
+	mu             sync.Mutex
+}
+
+// InFlight returns the number of requests currently using the key
+func (k *APIKey) InFlight() int64 {
+	return k.inFlight.Load()
+}
+
+// saturated reports whether the key has as many requests in flight as it may
+// have. Must be called with the load balancer's lock held.
+func (k *APIKey) saturated() bool {
+	return k.config.MaxConcurrency > 0 && k.InFlight() >= int64(k.config.MaxConcurrency)
+}
+
+// IsDisabled reports whether the key has been quarantined
+func (k *APIKey) IsDisabled() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.disabled
 }
 
 // LoadBalancer manages multiple API keys and distributes requests
 type LoadBalancer struct {
 	apiKeys      []*APIKey
 	currentIndex atomic.Uint32
-	config       *config.NVIDIAConfig
+	config       *config.UpstreamConfig
 	mu           sync.RWMutex
+
+	// Keys removed by a reload that still have requests in flight
+	draining []*APIKey
+
+	// Shares the keys' rate limiter buckets with other replicas, if set
+	shared RateLimiterBackend
+
+	// Callers blocked in Acquire, and the keys handed to each client since
+	// the queue formed so they can be served fairly
+	waiters       *list.List
+	served        map[string]int
+	dispatchTimer *time.Timer
+	queueMu       sync.Mutex
 }
 
-// NewLoadBalancer creates a new load balancer with the given API keys
-func NewLoadBalancer(cfg *config.NVIDIAConfig) *LoadBalancer {
+// NewLoadBalancer creates a new load balancer with the given API keys. Keys
+// found in the saved state, e.g. from before a restart, pick up where they
+// left off.
+func NewLoadBalancer(cfg *config.UpstreamConfig, saved ...KeyState) *LoadBalancer {
+	keys := cfg.KeyConfigs()
 	lb := &LoadBalancer{
-		apiKeys: make([]*APIKey, len(cfg.APIKeys)),
+		apiKeys: make([]*APIKey, len(keys)),
 		config:  cfg,
+		waiters: list.New(),
+	}
+
+	states := make(map[string]KeyState, len(saved))
+	for _, s := range saved {
+		states[s.KeyHash] = s
 	}
 
-	for i, key := range cfg.APIKeys {
-		lb.apiKeys[i] = &APIKey{
-			Key:         key,
-			RateLimiter: NewRateLimiter(cfg.RateLimit),
-			LastUsed:    time.Now(),
+	for i, kc := range keys {
+		lb.apiKeys[i] = newAPIKey(kc, cfg)
+		if s, ok := states[hashKey(kc.Key)]; ok {
+			lb.apiKeys[i].restore(s)
 		}
 	}
 
 	return lb
 }
 
-// GetNextKey returns the next available API key using round-robin with rate limiting
+// newAPIKey creates a key with a fresh rate limiter and circuit breaker
+func newAPIKey(kc config.KeyConfig, cfg *config.UpstreamConfig) *APIKey {
+	cooldown := time.Duration(cfg.CircuitBreaker.Cooldown) * time.Second
+	return &APIKey{
+		Key:          kc.Key,
+		Weight:       kc.Weight,
+		Tier:         kc.Tier,
+		config:       kc,
+		RateLimiter:  newRateLimiter(kc.Limiter, kc.RateLimit, kc.Burst, time.Now),
+		TokenLimiter: NewTokenLimiter(cfg.TokensPerMinute),
+		Quota:        NewQuota(kc.Quota),
+		Breaker:      NewCircuitBreaker(cfg.CircuitBreaker.FailureThreshold, cooldown),
+		Health:       NewKeyHealth(),
+		LastUsed:     time.Now(),
+	}
+}
+
+// Reload applies new upstream settings. Keys that are still configured keep
+// their limiter state and counters, new keys join the rotation and removed
+// keys stop being handed out and are dropped once their in-flight requests
+// have been released.
+func (lb *LoadBalancer) Reload(cfg *config.UpstreamConfig) {
+	cooldown := time.Duration(cfg.CircuitBreaker.Cooldown) * time.Second
+
+	lb.queueMu.Lock()
+	lb.mu.Lock()
+
+	// A key removed and added back while draining keeps its state too
+	current := make(map[string]*APIKey, len(lb.apiKeys)+len(lb.draining))
+	for _, key := range lb.draining {
+		current[key.Key] = key
+	}
+	for _, key := range lb.apiKeys {
+		current[key.Key] = key
+	}
+
+	configured := cfg.KeyConfigs()
+	keys := make([]*APIKey, 0, len(configured))
+	for _, kc := range configured {
+		key, ok := current[kc.Key]
+		if !ok {
+			key = newAPIKey(kc, cfg)
+			if lb.shared != nil {
+				key.RateLimiter.Share(lb.shared, hashKey(kc.Key))
+			}
+			keys = append(keys, key)
+			continue
+		}
+
+		key.configure(kc)
+		key.TokenLimiter.SetLimit(cfg.TokensPerMinute)
+		key.Quota.Configure(kc.Quota)
+		key.Breaker.Configure(cfg.CircuitBreaker.FailureThreshold, cooldown)
+		delete(current, kc.Key)
+		keys = append(keys, key)
+	}
+
+	lb.draining = lb.draining[:0]
+	for _, key := range current {
+		lb.draining = append(lb.draining, key)
+	}
+	lb.pruneDrainedLocked()
+
+	lb.apiKeys = keys
+	lb.currentIndex.Store(0)
+	lb.config = cfg
+
+	lb.mu.Unlock()
+	lb.queueMu.Unlock()
+
+	// New keys may serve callers already waiting
+	lb.notifyWaiters()
+}
+
+// ShareRateLimits keeps the keys' request buckets in a backend shared with
+// other proxy replicas, so together they stay within each key's rate limit.
+// Buckets are named by key hash, never by the raw key.
+func (lb *LoadBalancer) ShareRateLimits(backend RateLimiterBackend) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.shared = backend
+	for _, key := range lb.apiKeys {
+		key.RateLimiter.Share(backend, hashKey(key.Key))
+		key.shareModels(backend)
+	}
+}
+
+// Release hands a key back once the request using it has finished
+func (lb *LoadBalancer) Release(key *APIKey) {
+	if key == nil {
+		return
+	}
+	remaining := key.inFlight.Add(-1)
+
+	// Callers may be queued waiting for a slot on a saturated key
+	lb.mu.RLock()
+	limited := key.config.MaxConcurrency > 0
+	lb.mu.RUnlock()
+	if limited {
+		lb.notifyWaiters()
+	}
+
+	if remaining > 0 {
+		return
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.pruneDrainedLocked()
+}
+
+// pruneDrainedLocked forgets removed keys with nothing left in flight. Must
+// be called with the write lock held.
+func (lb *LoadBalancer) pruneDrainedLocked() {
+	remaining := lb.draining[:0]
+	for _, key := range lb.draining {
+		if key.InFlight() > 0 {
+			remaining = append(remaining, key)
+		}
+	}
+	lb.draining = remaining
+}
+
+// DrainingCount returns the number of removed keys still serving requests
+func (lb *LoadBalancer) DrainingCount() int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return len(lb.draining)
+}
+
+// AcquireOptions narrows down which keys may be handed out for a request
+type AcquireOptions struct {
+	// Exclude lists keys already tried for this request
+	Exclude []*APIKey
+	// NoWait fails with ErrKeysExhausted instead of queueing when no key is
+	// available right away
+	NoWait bool
+	// Tokens is the estimated prompt and completion tokens to reserve from
+	// the key's tokens per minute, settled later with SettleTokens
+	Tokens int
+	// Model restricts the keys to those serving the model and applies the
+	// key's rate limit for the model
+	Model string
+	// Client identifies the caller, so keys are shared fairly between
+	// clients while requests are queued
+	Client string
+	// Affinity identifies a conversation or client whose requests should
+	// keep going to the same key, whatever the strategy. Another key is only
+	// used while that one is unavailable.
+	Affinity string
+}
+
+// excludes reports whether the key must not be handed out
+func (o AcquireOptions) excludes(key *APIKey) bool {
+	for _, k := range o.Exclude {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNextKey returns the next available API key using the upstream's key
+// selection strategy with request and token rate limiting. Like a key from
+// Acquire, it counts against the key's max_concurrency until the caller
+// passes it to Release.
 func (lb *LoadBalancer) GetNextKey() (*APIKey, error) {
+	for {
+		lb.queueMu.Lock()
+		p, err := lb.selectKey(AcquireOptions{})
+		lb.queueMu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+		if lb.take(p, AcquireOptions{}) {
+			return p.key, nil
+		}
+	}
+}
+
+// pick is a key selected for a request, along with the shared buckets the
+// request still has to be taken from
+type pick struct {
+	key     *APIKey
+	pending []*RateLimiter
+}
+
+// selectKey picks the next available key that satisfies the options, trying
+// keys in the order of the selection strategy. Shared buckets are only
+// reserved from as last seen; take completes the pick. Must be called with
+// queueMu held so strategies see each other's picks.
+func (lb *LoadBalancer) selectKey(opts AcquireOptions) (pick, error) {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
 	totalKeys := len(lb.apiKeys)
 	if totalKeys == 0 {
-		return nil, fmt.Errorf("no API keys available")
+		return pick{}, fmt.Errorf("no API keys available")
 	}
 
-	// Try all keys starting from the current index
-	startIndex := lb.currentIndex.Load()
-
-	for i := 0; i < totalKeys; i++ {
-		// Round-robin: get next index
-		index := (startIndex + uint32(i)) % uint32(totalKeys)
+	for _, index := range lb.candidates(opts.Affinity) {
 		key := lb.apiKeys[index]
 
-		// Try to acquire a token from this key's rate limiter
-		if key.RateLimiter.TryAcquire() {
-			// Update current index for next request
-			lb.currentIndex.Store((index + 1) % uint32(totalKeys))
+		if opts.excludes(key) || !key.servesModel(opts.Model) {
+			continue
+		}
 
-			// Update statistics
+		// Skip quarantined keys, keys out of quota, keys with as many requests
+		// in flight as they may have and keys whose circuit is open
+		if key.IsDisabled() || key.Quota.Exhausted() || key.saturated() || !key.Breaker.Allow() {
+			continue
+		}
+
+		// Reserve the estimated tokens, then a request from the key's model and
+		// key rate limiters
+		if !key.TokenLimiter.TryReserve(opts.Tokens) {
+			key.Breaker.Cancel()
+			continue
+		}
+		var pending []*RateLimiter
+		modelLimiter := key.modelLimiter(opts.Model, lb.shared)
+		if modelLimiter != nil {
+			ok, shared := modelLimiter.reserve()
+			if !ok {
+				key.TokenLimiter.Settle(opts.Tokens, 0)
+				key.Breaker.Cancel()
+				continue
+			}
+			if shared {
+				pending = append(pending, modelLimiter)
+			}
+		}
+		if ok, shared := key.RateLimiter.reserve(); ok {
+			if shared {
+				pending = append(pending, key.RateLimiter)
+			}
+			lb.picked(index)
 			key.LastUsed = time.Now()
-			key.RequestCount.Add(1)
+			key.inFlight.Add(1)
+
+			return pick{key: key, pending: pending}, nil
+		}
 
-			return key, nil
+		// Give back the tokens, model request and half-open trial slot we
+		// could not use
+		if modelLimiter != nil {
+			modelLimiter.refund()
 		}
+		key.TokenLimiter.Settle(opts.Tokens, 0)
+		key.Breaker.Cancel()
 	}
 
 	// All keys are rate limited
-	return nil, fmt.Errorf("all API keys are rate limited, please wait")
+	return pick{}, ErrKeysExhausted
 }
 
-// GetKeyWithRetry attempts to get a key with retry logic
-func (lb *LoadBalancer) GetKeyWithRetry(maxRetries int) (*APIKey, error) {
-	var lastErr error
+// take completes a pick, taking the request from the key's shared buckets
+// and counting it. Another replica may have drained a bucket since it was
+// last seen, in which case the pick is undone and false returned. It waits
+// for the shared backend, so it must be called without any locks held.
+func (lb *LoadBalancer) take(p pick, opts AcquireOptions) bool {
+	if len(p.pending) > 0 && !takeShared(p.pending) {
+		p.key.TokenLimiter.Settle(opts.Tokens, 0)
+		p.key.Breaker.Cancel()
+		lb.Release(p.key)
+		return false
+	}
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		key, err := lb.GetNextKey()
-		if err == nil {
-			return key, nil
-		}
+	p.key.RequestCount.Add(1)
+	p.key.Quota.AddRequest()
+	return true
+}
 
-		lastErr = err
+// CanFailover reports whether any key outside the excluded set could still
+// serve a request for the model, so a retry is worth attempting
+func (lb *LoadBalancer) CanFailover(exclude []*APIKey, model string) bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
 
-		// Wait a bit before retrying
-		if attempt < maxRetries-1 {
-			time.Sleep(time.Second * time.Duration(attempt+1))
+	opts := AcquireOptions{Exclude: exclude}
+	for _, key := range lb.apiKeys {
+		if !opts.excludes(key) && key.servesModel(model) && !key.IsDisabled() && !key.Quota.Exhausted() {
+			return true
 		}
 	}
-
-	return nil, fmt.Errorf("failed to get API key after %d retries: %w", maxRetries, lastErr)
+	return false
 }
 
-// MarkKeyError increments the error count for a key
+// MarkKeyError increments the error count for a key and records the failure
+// with its circuit breaker and health
 func (lb *LoadBalancer) MarkKeyError(key *APIKey) {
 	if key != nil {
 		key.ErrorCount.Add(1)
+		key.Breaker.RecordFailure()
+		key.Health.ObserveOutcome(true)
+	}
+}
+
+// MarkKeySuccess records a successful upstream response for a key, closing
+// its circuit breaker
+func (lb *LoadBalancer) MarkKeySuccess(key *APIKey) {
+	if key != nil {
+		key.Breaker.RecordSuccess()
+		key.Health.ObserveOutcome(false)
+		key.forbidden.Store(0)
+	}
+}
+
+// ObserveTTFB records how long the upstream took to start responding to a
+// request made with the key
+func (lb *LoadBalancer) ObserveTTFB(key *APIKey, d time.Duration) {
+	if key != nil {
+		key.Health.ObserveTTFB(d)
+	}
+}
+
+// RecordUsage adds the tokens an upstream reported for a request to the key
+// and its quota
+func (lb *LoadBalancer) RecordUsage(key *APIKey, promptTokens, completionTokens int) {
+	if key == nil {
+		return
+	}
+	key.Quota.AddTokens(promptTokens + completionTokens)
+	if promptTokens > 0 {
+		key.PromptTokens.Add(uint64(promptTokens))
+	}
+	if completionTokens > 0 {
+		key.CompletionTokens.Add(uint64(completionTokens))
+	}
+}
+
+// SettleTokens replaces the tokens reserved for a request with the tokens it
+// actually used. Pass 0 as used to give back the reservation of a request
+// upstream did not process.
+func (lb *LoadBalancer) SettleTokens(key *APIKey, reserved, used int) {
+	if key == nil || reserved == used {
+		return
+	}
+
+	key.TokenLimiter.Settle(reserved, used)
+
+	// Callers may be queued waiting for the tokens given back
+	if used < reserved {
+		lb.notifyWaiters()
+	}
+}
+
+// ApplyUpstreamLimits feeds rate limit headers from an upstream response back
+// into the key's limiter so our view converges with the real upstream quota
+func (lb *LoadBalancer) ApplyUpstreamLimits(key *APIKey, limits UpstreamLimits) {
+	if key == nil {
+		return
+	}
+
+	now := time.Now()
+	if limits.RetryAfter > 0 {
+		key.RateLimiter.PauseUntil(now.Add(limits.RetryAfter))
+		return
+	}
+
+	if limits.HasRemaining {
+		key.RateLimiter.Sync(limits.Remaining, now.Add(limits.Reset))
+	}
+}
+
+// DisableKey quarantines a key so it is no longer handed out, e.g. after the
+// upstream rejected it as revoked or invalid
+func (lb *LoadBalancer) DisableKey(key *APIKey, reason string) {
+	if key == nil {
+		return
+	}
+
+	key.mu.Lock()
+	defer key.mu.Unlock()
+
+	if key.disabled {
+		return
 	}
+	key.disabled = true
+	key.disabledReason = reason
+	key.disabledAt = time.Now()
+}
+
+// forbiddenToDisable is how many 403s in a row, for any models, a key must
+// get before they are blamed on the key rather than on the models
+const forbiddenToDisable = 3
+
+// MarkForbidden records that the upstream refused the key with 403 for a
+// model, and reports whether the key should be disabled: when it was refused
+// too many times since its last success, or for a request not about any
+// model. A refusal says nothing about the key's health, so a half-open
+// circuit breaker trial is given back rather than recorded.
+func (lb *LoadBalancer) MarkForbidden(key *APIKey, model string) bool {
+	key.Breaker.Cancel()
+	if model == "" {
+		return true
+	}
+	return key.forbidden.Add(1) >= forbiddenToDisable
+}
+
+// EnableKey puts a quarantined key back into rotation by its index
+func (lb *LoadBalancer) EnableKey(index int) error {
+	lb.mu.RLock()
+	if index < 0 || index >= len(lb.apiKeys) {
+		lb.mu.RUnlock()
+		return fmt.Errorf("no API key at index %d", index)
+	}
+	key := lb.apiKeys[index]
+	lb.mu.RUnlock()
+
+	key.mu.Lock()
+	if !key.disabled {
+		key.mu.Unlock()
+		return fmt.Errorf("API key at index %d is not disabled", index)
+	}
+	key.disabled = false
+	key.disabledReason = ""
+	key.disabledAt = time.Time{}
+	key.forbidden.Store(0)
+	key.mu.Unlock()
+
+	// Start from a clean slate rather than an open circuit
+	key.Breaker.RecordSuccess()
+
+	// Callers may be queued waiting for exactly this key
+	lb.notifyWaiters()
+
+	return nil
+}
+
+// GetDisabledKeys returns the quarantined keys
+func (lb *LoadBalancer) GetDisabledKeys() []DisabledKey {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	disabled := make([]DisabledKey, 0)
+	for i, key := range lb.apiKeys {
+		key.mu.Lock()
+		if key.disabled {
+			disabled = append(disabled, DisabledKey{
+				Index:      i,
+				KeyPrefix:  MaskAPIKey(key.Key),
+				Reason:     key.disabledReason,
+				DisabledAt: key.disabledAt,
+			})
+		}
+		key.mu.Unlock()
+	}
+
+	return disabled
+}
+
+// KeyCount returns the number of configured API keys
+func (lb *LoadBalancer) KeyCount() int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return len(lb.apiKeys)
 }
 
 // GetStats returns statistics for all API keys
@@ -112,14 +580,37 @@ func (lb *LoadBalancer) GetStats() []KeyStats {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
+	scores := healthScores(lb.apiKeys)
 	stats := make([]KeyStats, len(lb.apiKeys))
 	for i, key := range lb.apiKeys {
+		key.mu.Lock()
+		disabled, reason := key.disabled, key.disabledReason
+		key.mu.Unlock()
+
 		stats[i] = KeyStats{
-			KeyPrefix:       MaskAPIKey(key.Key),
-			RequestCount:    key.RequestCount.Load(),
-			ErrorCount:      key.ErrorCount.Load(),
-			AvailableTokens: key.RateLimiter.AvailableTokens(),
-			LastUsed:        key.LastUsed,
+			KeyPrefix:        MaskAPIKey(key.Key),
+			KeyID:            hashKey(key.Key)[:keyIDLength],
+			RequestCount:     key.RequestCount.Load(),
+			ErrorCount:       key.ErrorCount.Load(),
+			PromptTokens:     key.PromptTokens.Load(),
+			CompletionTokens: key.CompletionTokens.Load(),
+			AvailableTokens:  key.RateLimiter.AvailableTokens(),
+			AvailableTPM:     key.TokenLimiter.AvailableTokens(),
+			Models:           key.config.Models,
+			AvailableByModel: key.modelStats(),
+			Quota:            key.Quota.Stats(),
+			InFlight:         key.InFlight(),
+			MaxConcurrency:   key.config.MaxConcurrency,
+			Weight:           key.Weight,
+			Tier:             key.Tier,
+			Limiter:          key.RateLimiter.Algorithm(),
+			AvgTTFBMs:        float64(key.Health.TTFB()) / float64(time.Millisecond),
+			ErrorRate:        key.Health.ErrorRate(),
+			HealthScore:      scores[i],
+			CircuitState:     key.Breaker.State().String(),
+			Disabled:         disabled,
+			DisabledReason:   reason,
+			LastUsed:         key.LastUsed,
 		}
 	}
 
@@ -128,11 +619,37 @@ func (lb *LoadBalancer) GetStats() []KeyStats {
 
 // KeyStats represents statistics for an API key
 type KeyStats struct {
-	KeyPrefix       string
-	RequestCount    uint64
-	ErrorCount      uint64
-	AvailableTokens int
-	LastUsed        time.Time
+	KeyPrefix        string
+	KeyID            string // short hash of the key, unique where prefixes may not be
+	RequestCount     uint64
+	ErrorCount       uint64
+	PromptTokens     uint64
+	CompletionTokens uint64
+	AvailableTokens  int
+	AvailableTPM     int            // -1 without a tokens per minute limit
+	Models           []string       // patterns of the models served, empty for all
+	AvailableByModel map[string]int // requests left per model limit pattern
+	Quota            *QuotaStats    // nil without a quota
+	InFlight         int64
+	MaxConcurrency   int // 0 without a limit
+	Weight           int
+	Tier             int
+	Limiter          string  // rate limit algorithm
+	AvgTTFBMs        float64 // moving average of the time to first byte
+	ErrorRate        float64 // moving average share of failed requests
+	HealthScore      float64 // expected seconds to a successful response, lower is better
+	CircuitState     string
+	Disabled         bool
+	DisabledReason   string
+	LastUsed         time.Time
+}
+
+// DisabledKey describes a quarantined API key
+type DisabledKey struct {
+	Index      int
+	KeyPrefix  string
+	Reason     string
+	DisabledAt time.Time
 }
 
 // MaskAPIKey masks an API key for security, showing only first and last few characters
@@ -1,7 +1,10 @@
 package balancer
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/luongndcoder/proxypal-nvidia/internal/config"
 )
@@ -79,6 +82,11 @@ func TestLoadBalancer_GetStats(t *testing.T) {
 	if stats[1].RequestCount != 0 {
 		t.Errorf("Expected request count 0 for second key, got %d", stats[1].RequestCount)
 	}
+
+	// Short keys mask alike, so only the key ID tells them apart
+	if stats[0].KeyID == stats[1].KeyID || len(stats[0].KeyID) != keyIDLength {
+		t.Errorf("Expected distinct key IDs, got %q and %q", stats[0].KeyID, stats[1].KeyID)
+	}
 }
 
 func TestLoadBalancer_MarkKeyError(t *testing.T) {
@@ -116,3 +124,364 @@ func TestMaskAPIKey(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadBalancer_CircuitBreakerSkipsKey(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1", "key2"},
+		RateLimit: 40,
+		CircuitBreaker: config.CircuitBreakerConfig{
+			FailureThreshold: 2,
+			Cooldown:         30,
+		},
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	lb.MarkKeyError(lb.apiKeys[0])
+	lb.MarkKeyError(lb.apiKeys[0])
+
+	for i := 0; i < 4; i++ {
+		key, err := lb.GetNextKey()
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+		if key.Key != "key2" {
+			t.Errorf("Expected key with open circuit to be skipped, got %s", key.Key)
+		}
+	}
+
+	stats := lb.GetStats()
+	if stats[0].CircuitState != "open" {
+		t.Errorf("Expected open circuit in stats, got %s", stats[0].CircuitState)
+	}
+}
+
+func TestLoadBalancer_DisableKey(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1", "key2"},
+		RateLimit: 40,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.DisableKey(lb.apiKeys[0], "upstream returned 401 Unauthorized")
+
+	for i := 0; i < 4; i++ {
+		key, err := lb.GetNextKey()
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+		if key.Key != "key2" {
+			t.Errorf("Expected disabled key to be skipped, got %s", key.Key)
+		}
+	}
+
+	disabled := lb.GetDisabledKeys()
+	if len(disabled) != 1 {
+		t.Fatalf("Expected 1 disabled key, got %d", len(disabled))
+	}
+	if disabled[0].Index != 0 || disabled[0].Reason != "upstream returned 401 Unauthorized" {
+		t.Errorf("Unexpected disabled key entry: %+v", disabled[0])
+	}
+	if disabled[0].DisabledAt.IsZero() {
+		t.Error("Expected disabled timestamp to be set")
+	}
+}
+
+func TestLoadBalancer_MarkForbidden(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+		CircuitBreaker: config.CircuitBreakerConfig{
+			FailureThreshold: 2,
+			Cooldown:         30,
+		},
+	}
+
+	lb := NewLoadBalancer(cfg)
+	key := lb.apiKeys[0]
+
+	// Refusals for the same model add up, and don't close the breaker
+	lb.MarkKeyError(key)
+	for i := 1; i < forbiddenToDisable; i++ {
+		if lb.MarkForbidden(key, "m1") {
+			t.Fatalf("Expected the key to be kept after %d refusals", i)
+		}
+	}
+	lb.MarkKeyError(key)
+	if state := key.Breaker.State(); state != CircuitOpen {
+		t.Errorf("Expected 403s not to reset the breaker, got %v", state)
+	}
+	if !lb.MarkForbidden(key, "m1") {
+		t.Errorf("Expected the key to be disabled after %d refusals", forbiddenToDisable)
+	}
+
+	// A success in between starts the count again
+	lb.MarkKeySuccess(key)
+	if lb.MarkForbidden(key, "m1") {
+		t.Error("Expected the count to restart after a success")
+	}
+}
+
+func TestLoadBalancer_EnableKey(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.DisableKey(lb.apiKeys[0], "upstream returned 403 Forbidden")
+
+	if _, err := lb.GetNextKey(); err == nil {
+		t.Fatal("Expected no key while the only key is disabled")
+	}
+
+	if err := lb.EnableKey(0); err != nil {
+		t.Fatalf("Failed to enable key: %v", err)
+	}
+
+	if _, err := lb.GetNextKey(); err != nil {
+		t.Errorf("Expected re-enabled key to be handed out: %v", err)
+	}
+
+	if err := lb.EnableKey(0); err == nil {
+		t.Error("Expected error when enabling a key that is not disabled")
+	}
+
+	if err := lb.EnableKey(5); err == nil {
+		t.Error("Expected error for out-of-range index")
+	}
+}
+
+func TestLoadBalancer_ApplyUpstreamLimits(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	key := lb.apiKeys[0]
+
+	lb.ApplyUpstreamLimits(key, UpstreamLimits{Remaining: 5, HasRemaining: true, Reset: time.Minute})
+	if tokens := key.RateLimiter.AvailableTokens(); tokens != 5 {
+		t.Errorf("Expected limiter to resync to 5 tokens, got %d", tokens)
+	}
+
+	lb.ApplyUpstreamLimits(key, UpstreamLimits{RetryAfter: 10 * time.Second})
+	if _, err := lb.GetNextKey(); err == nil {
+		t.Error("Expected key to be paused after Retry-After")
+	}
+}
+
+func TestLoadBalancer_AcquireExclude(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1", "key2"},
+		RateLimit: 40,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	tried := []*APIKey{lb.apiKeys[0]}
+
+	for i := 0; i < 3; i++ {
+		key, err := lb.Acquire(context.Background(), AcquireOptions{Exclude: tried})
+		if err != nil {
+			t.Fatalf("Failed to acquire key: %v", err)
+		}
+		if key.Key != "key2" {
+			t.Errorf("Expected excluded key to be skipped, got %s", key.Key)
+		}
+	}
+
+	if !lb.CanFailover(tried, "") {
+		t.Error("Expected failover to key2 to be possible")
+	}
+
+	tried = append(tried, lb.apiKeys[1])
+	if lb.CanFailover(tried, "") {
+		t.Error("Expected no failover once every key was tried")
+	}
+}
+
+func TestLoadBalancer_Reload(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1", "key2"},
+		RateLimit: 40,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	kept, _ := lb.GetNextKey()
+	removed, _ := lb.GetNextKey()
+	if kept.Key != "key1" || removed.Key != "key2" {
+		t.Fatalf("Unexpected keys %s, %s", kept.Key, removed.Key)
+	}
+	lb.Release(kept)
+
+	lb.Reload(&config.NVIDIAConfig{
+		APIKeys:   []string{"key1", "key3"},
+		RateLimit: 40,
+	})
+
+	if lb.KeyCount() != 2 {
+		t.Fatalf("Expected 2 keys after reload, got %d", lb.KeyCount())
+	}
+
+	// The kept key is the same key with its counters and bucket intact
+	stats := lb.GetStats()
+	if stats[0].RequestCount != 1 || stats[0].AvailableTokens != 39 {
+		t.Errorf("Expected key1 to keep its state, got %+v", stats[0])
+	}
+	if stats[1].RequestCount != 0 || stats[1].AvailableTokens != 40 {
+		t.Errorf("Expected key3 to start fresh, got %+v", stats[1])
+	}
+
+	// The removed key is never handed out again but drains its request
+	for i := 0; i < 10; i++ {
+		key, err := lb.GetNextKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == removed {
+			t.Fatal("Removed key must not be handed out")
+		}
+		lb.Release(key)
+	}
+	if lb.DrainingCount() != 1 {
+		t.Errorf("Expected 1 draining key, got %d", lb.DrainingCount())
+	}
+
+	lb.Release(removed)
+	if lb.DrainingCount() != 0 {
+		t.Errorf("Expected drained key to be dropped, got %d", lb.DrainingCount())
+	}
+}
+
+func TestLoadBalancer_ReloadRateLimit(t *testing.T) {
+	lb := NewLoadBalancer(&config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+	})
+
+	lb.Reload(&config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 10,
+	})
+
+	if tokens := lb.GetStats()[0].AvailableTokens; tokens != 10 {
+		t.Errorf("Expected bucket clamped to the new limit 10, got %d", tokens)
+	}
+}
+
+func TestLoadBalancer_RecordUsage(t *testing.T) {
+	lb := NewLoadBalancer(&config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+	})
+
+	key, _ := lb.GetNextKey()
+	lb.RecordUsage(key, 120, 30)
+	lb.RecordUsage(key, 80, 20)
+
+	stats := lb.GetStats()[0]
+	if stats.PromptTokens != 200 || stats.CompletionTokens != 50 {
+		t.Errorf("Expected 200 prompt and 50 completion tokens, got %d and %d", stats.PromptTokens, stats.CompletionTokens)
+	}
+}
+
+func TestLoadBalancer_TokensPerMinute(t *testing.T) {
+	lb := NewLoadBalancer(&config.NVIDIAConfig{
+		APIKeys:         []string{"key1", "key2"},
+		RateLimit:       40,
+		TokensPerMinute: 1000,
+	})
+
+	// A large request uses up most of key1's token budget
+	big, err := lb.Acquire(context.Background(), AcquireOptions{Tokens: 900})
+	if err != nil || big.Key != "key1" {
+		t.Fatalf("Expected key1, got %v (%v)", big, err)
+	}
+
+	// Round-robin moves on to key2 and then back to key1
+	if key, _ := lb.GetNextKey(); key.Key != "key2" {
+		t.Fatalf("Expected key2, got %s", key.Key)
+	}
+
+	// key1 still has requests left but not enough tokens
+	key, err := lb.Acquire(context.Background(), AcquireOptions{Tokens: 500, NoWait: true})
+	if err != nil || key.Key != "key2" {
+		t.Fatalf("Expected key2 for a request key1 has no tokens for, got %v (%v)", key, err)
+	}
+	if _, err := lb.Acquire(context.Background(), AcquireOptions{Tokens: 600, NoWait: true}); !errors.Is(err, ErrKeysExhausted) {
+		t.Errorf("Expected ErrKeysExhausted, got %v", err)
+	}
+
+	// Settling with the actual usage frees key1's budget again
+	lb.SettleTokens(big, 900, 100)
+	if stats := lb.GetStats()[0]; stats.AvailableTPM != 900 {
+		t.Errorf("Expected 900 tokens after settling, got %d", stats.AvailableTPM)
+	}
+	key, err = lb.Acquire(context.Background(), AcquireOptions{Tokens: 600, NoWait: true})
+	if err != nil || key.Key != "key1" {
+		t.Errorf("Expected key1 after settling, got %v (%v)", key, err)
+	}
+}
+
+func TestLoadBalancer_SkipsExhaustedQuota(t *testing.T) {
+	lb := NewLoadBalancer(&config.NVIDIAConfig{
+		APIKeys:   []string{"key1", "key2"},
+		RateLimit: 40,
+		Quota:     config.QuotaConfig{RequestsPerDay: 1},
+	})
+
+	for _, want := range []string{"key1", "key2"} {
+		key, err := lb.GetNextKey()
+		if err != nil || key.Key != want {
+			t.Fatalf("Expected %s, got %v (%v)", want, key, err)
+		}
+	}
+
+	if _, err := lb.GetNextKey(); !errors.Is(err, ErrKeysExhausted) {
+		t.Errorf("Expected ErrKeysExhausted once every quota is used up, got %v", err)
+	}
+	if lb.CanFailover(nil, "") {
+		t.Error("Expected no failover to keys out of quota")
+	}
+
+	stats := lb.GetStats()[0]
+	if stats.Quota == nil || stats.Quota.RequestsLeftToday != 0 {
+		t.Errorf("Expected no requests left today, got %+v", stats.Quota)
+	}
+}
+
+func TestLoadBalancer_KeyQuota(t *testing.T) {
+	lb := NewLoadBalancer(&config.NVIDIAConfig{
+		RateLimit: 40,
+		Quota:     config.QuotaConfig{RequestsPerDay: 1},
+		Keys: []config.KeyConfig{
+			{Key: "key1"},
+			{Key: "key2", Quota: config.QuotaConfig{RequestsPerDay: 3}},
+		},
+	})
+
+	// key1 has the upstream's budget of one request, key2 its own three
+	for _, want := range []string{"key1", "key2", "key2", "key2"} {
+		key, err := lb.GetNextKey()
+		if err != nil || key.Key != want {
+			t.Fatalf("Expected %s, got %v (%v)", want, key, err)
+		}
+	}
+	if _, err := lb.GetNextKey(); !errors.Is(err, ErrKeysExhausted) {
+		t.Errorf("Expected ErrKeysExhausted once every quota is used up, got %v", err)
+	}
+
+	// Reloading applies a key's new quota
+	lb.Reload(&config.NVIDIAConfig{
+		RateLimit: 40,
+		Quota:     config.QuotaConfig{RequestsPerDay: 1},
+		Keys: []config.KeyConfig{
+			{Key: "key1", Quota: config.QuotaConfig{RequestsPerDay: 2}},
+			{Key: "key2", Quota: config.QuotaConfig{RequestsPerDay: 3}},
+		},
+	})
+	if key, err := lb.GetNextKey(); err != nil || key.Key != "key1" {
+		t.Errorf("Expected key1 to get its raised quota, got %v (%v)", key, err)
+	}
+}
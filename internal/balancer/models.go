@@ -0,0 +1,122 @@
+package balancer
+
+import (
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// servesModel reports whether the key may be used for the model. An empty
+// model is served by every key. Must be called with the load balancer's lock
+// held, as reloads change the key's settings.
+func (k *APIKey) servesModel(model string) bool {
+	return model == "" || k.config.ServesModel(model)
+}
+
+// modelLimiter returns the key's rate limiter for the model limit matching
+// the model, creating it on first use, or nil when only the key's own rate
+// limit applies. Models matching the same pattern share a limiter, so
+// clients cannot grow them by naming new models. Must be called with the
+// load balancer's lock held.
+func (k *APIKey) modelLimiter(model string, shared RateLimiterBackend) *RateLimiter {
+	if model == "" {
+		return nil
+	}
+	limit, ok := k.config.ModelLimit(model)
+	if !ok {
+		return nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if rl, ok := k.modelLimiters[limit.Model]; ok {
+		return rl
+	}
+
+	rl := newRateLimiter(k.config.Limiter, limit.RateLimit, 0, time.Now)
+	if shared != nil {
+		rl.Share(shared, modelBucket(k.Key, limit.Model))
+	}
+	if k.modelLimiters == nil {
+		k.modelLimiters = make(map[string]*RateLimiter)
+	}
+	k.modelLimiters[limit.Model] = rl
+	return rl
+}
+
+// configure applies new key settings, keeping the state of model limiters
+// whose pattern is still limited. Must be called with the load balancer's
+// write lock held.
+func (k *APIKey) configure(kc config.KeyConfig) {
+	k.config = kc
+	k.Weight, k.Tier, k.currentWeight = kc.Weight, kc.Tier, 0
+	k.RateLimiter.configure(kc.Limiter, kc.RateLimit, kc.Burst)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for pattern, rl := range k.modelLimiters {
+		if limit := patternRateLimit(kc, pattern); limit > 0 {
+			rl.configure(kc.Limiter, limit, 0)
+		} else {
+			delete(k.modelLimiters, pattern)
+		}
+	}
+}
+
+// patternRateLimit returns the rate limit of the key's first model limit with
+// the pattern, 0 when there is none
+func patternRateLimit(kc config.KeyConfig, pattern string) int {
+	for _, limit := range kc.ModelLimits {
+		if limit.Model == pattern {
+			return limit.RateLimit
+		}
+	}
+	return 0
+}
+
+// shareModels keeps the key's model limiter buckets in a shared backend
+func (k *APIKey) shareModels(backend RateLimiterBackend) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for pattern, rl := range k.modelLimiters {
+		rl.Share(backend, modelBucket(k.Key, pattern))
+	}
+}
+
+// modelStats returns the requests left per model limit pattern
+func (k *APIKey) modelStats() map[string]int {
+	k.mu.Lock()
+	limiters := make(map[string]*RateLimiter, len(k.modelLimiters))
+	for pattern, rl := range k.modelLimiters {
+		limiters[pattern] = rl
+	}
+	k.mu.Unlock()
+
+	stats := make(map[string]int, len(limiters))
+	for pattern, rl := range limiters {
+		stats[pattern] = rl.AvailableTokens()
+	}
+	return stats
+}
+
+// modelBucket names the shared bucket of a key's model limit pattern
+func modelBucket(key, pattern string) string {
+	return hashKey(key) + ":" + pattern
+}
+
+// servesModelLocked reports whether any key may be used for the model. Must
+// be called with the read lock held.
+func (lb *LoadBalancer) servesModelLocked(model string) bool {
+	if model == "" {
+		return true
+	}
+	for _, key := range lb.apiKeys {
+		if key.servesModel(model) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+func TestLoadBalancer_ModelPools(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		Keys: []config.KeyConfig{
+			{Key: "meta-only", Models: []string{"meta/*"}},
+			{Key: "mistral-only", Models: []string{"mistralai/*"}},
+		},
+	}
+	lb := NewLoadBalancer(cfg)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		key, err := lb.Acquire(ctx, AcquireOptions{Model: "mistralai/mixtral-8x22b", NoWait: true})
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+		if key.Key != "mistral-only" {
+			t.Errorf("Expected mistral-only, got %s", key.Key)
+		}
+	}
+
+	if _, err := lb.Acquire(ctx, AcquireOptions{Model: "google/gemma-2-9b"}); !errors.Is(err, ErrModelNotServed) {
+		t.Errorf("Expected ErrModelNotServed, got %v", err)
+	}
+
+	meta := lb.apiKeys[0]
+	if lb.CanFailover([]*APIKey{meta}, "meta/llama-3.1-8b-instruct") {
+		t.Errorf("Expected no failover without another key serving the model")
+	}
+}
+
+func TestLoadBalancer_ModelRateLimits(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit:   10,
+		APIKeys:     []string{"key1"},
+		ModelLimits: []config.ModelLimitConfig{{Model: "heavy*", RateLimit: 1}},
+	}
+	lb := NewLoadBalancer(cfg)
+	ctx := context.Background()
+
+	if _, err := lb.Acquire(ctx, AcquireOptions{Model: "heavy", NoWait: true}); err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+	if _, err := lb.Acquire(ctx, AcquireOptions{Model: "heavy", NoWait: true}); !errors.Is(err, ErrKeysExhausted) {
+		t.Errorf("Expected ErrKeysExhausted for the heavy model, got %v", err)
+	}
+	// Other models matching the pattern share its limiter
+	if _, err := lb.Acquire(ctx, AcquireOptions{Model: "heavy-v2", NoWait: true}); !errors.Is(err, ErrKeysExhausted) {
+		t.Errorf("Expected ErrKeysExhausted for another heavy model, got %v", err)
+	}
+
+	// The burst on the heavy model leaves the key's other requests alone
+	if _, err := lb.Acquire(ctx, AcquireOptions{Model: "cheap", NoWait: true}); err != nil {
+		t.Errorf("Expected the cheap model to still get a key, got %v", err)
+	}
+
+	stats := lb.GetStats()
+	if stats[0].AvailableTokens != 8 || len(stats[0].AvailableByModel) != 1 || stats[0].AvailableByModel["heavy*"] != 0 {
+		t.Errorf("Expected 8 requests left and none for heavy, got %d and %v", stats[0].AvailableTokens, stats[0].AvailableByModel)
+	}
+
+	// Dropping the model limit drops its limiter
+	lb.Reload(&config.NVIDIAConfig{RateLimit: 10, APIKeys: []string{"key1"}})
+	if _, err := lb.Acquire(ctx, AcquireOptions{Model: "heavy", NoWait: true}); err != nil {
+		t.Errorf("Expected the heavy model unlimited after reload, got %v", err)
+	}
+	if stats := lb.GetStats(); len(stats[0].AvailableByModel) != 0 {
+		t.Errorf("Expected no model limiters, got %v", stats[0].AvailableByModel)
+	}
+}
@@ -0,0 +1,286 @@
+package balancer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrKeysExhausted is returned when every key is rate limited or out of rotation
+	ErrKeysExhausted = errors.New("all API keys are rate limited, please wait")
+	// ErrQueueFull is returned when too many callers are already waiting for a key
+	ErrQueueFull = errors.New("request queue is full")
+	// ErrQueueTimeout is returned when no key became available within the max wait
+	ErrQueueTimeout = errors.New("timed out waiting for an available API key")
+	// ErrModelNotServed is returned when no configured key serves the model
+	ErrModelNotServed = errors.New("no API key is configured for the requested model")
+)
+
+const (
+	// minDispatchDelay avoids spinning when a refill is imminent
+	minDispatchDelay = 10 * time.Millisecond
+	// maxDispatchDelay bounds how long waiters sleep when no refill is
+	// predictable, e.g. all circuits are open
+	maxDispatchDelay = time.Second
+)
+
+// waiter is a caller blocked in Acquire
+type waiter struct {
+	opts  AcquireOptions
+	ready chan pick
+}
+
+// Acquire returns an available API key, waiting when all keys are rate
+// limited. Waiters are served fairly between clients and in FIFO order for
+// each client. It fails fast with ErrQueueFull when the queue is at its
+// maximum depth and with ErrQueueTimeout when the max wait elapses. With
+// NoWait set it never queues and fails with ErrKeysExhausted instead. The
+// caller must Release the key once its request is finished.
+func (lb *LoadBalancer) Acquire(ctx context.Context, opts AcquireOptions) (*APIKey, error) {
+	lb.mu.RLock()
+	maxWait := time.Duration(lb.config.Queue.MaxWait) * time.Second
+	lb.mu.RUnlock()
+
+	// The max wait covers the whole call, however many picks are undone
+	waitCtx := ctx
+	if maxWait > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, maxWait)
+		defer cancel()
+	}
+
+	for {
+		p, err := lb.acquire(ctx, waitCtx, opts)
+		if err != nil {
+			return nil, err
+		}
+		if lb.take(p, opts) {
+			return p.key, nil
+		}
+	}
+}
+
+// acquire picks a key for Acquire, queueing until waitCtx is done when none
+// is available
+func (lb *LoadBalancer) acquire(ctx, waitCtx context.Context, opts AcquireOptions) (pick, error) {
+	lb.queueMu.Lock()
+	lb.mu.RLock()
+	queue, served := lb.config.Queue, lb.servesModelLocked(opts.Model)
+	lb.mu.RUnlock()
+
+	// Waiting would not help when no key serves the model
+	if !served {
+		lb.queueMu.Unlock()
+		return pick{}, ErrModelNotServed
+	}
+
+	// Fast path: nobody is waiting ahead of us
+	if lb.waiters.Len() == 0 {
+		if p, err := lb.selectKey(opts); err == nil {
+			lb.queueMu.Unlock()
+			return p, nil
+		}
+	}
+
+	if opts.NoWait {
+		// Don't jump the queue, but keys no waiter could use are free to take
+		if lb.waiters.Len() > 0 {
+			queued := opts
+			queued.Exclude = append(slices.Clip(opts.Exclude), lb.queuedKeysLocked()...)
+			if p, err := lb.selectKey(queued); err == nil {
+				lb.queueMu.Unlock()
+				return p, nil
+			}
+		}
+		lb.queueMu.Unlock()
+		return pick{}, ErrKeysExhausted
+	}
+
+	if maxDepth := queue.MaxDepth; maxDepth > 0 && lb.waiters.Len() >= maxDepth {
+		lb.queueMu.Unlock()
+		return pick{}, ErrQueueFull
+	}
+
+	w := &waiter{opts: opts, ready: make(chan pick, 1)}
+	elem := lb.waiters.PushBack(w)
+	lb.scheduleDispatchLocked()
+	lb.queueMu.Unlock()
+
+	select {
+	case p := <-w.ready:
+		return p, nil
+	case <-waitCtx.Done():
+	}
+
+	lb.queueMu.Lock()
+	defer lb.queueMu.Unlock()
+
+	// A key may have been handed over while we were giving up
+	select {
+	case p := <-w.ready:
+		return p, nil
+	default:
+	}
+	lb.waiters.Remove(elem)
+	if lb.waiters.Len() == 0 {
+		lb.served = nil
+	}
+
+	if ctx.Err() != nil {
+		return pick{}, ctx.Err()
+	}
+	return pick{}, ErrQueueTimeout
+}
+
+// queuedKeysLocked returns the keys any queued waiter could use. Must be
+// called with queueMu held.
+func (lb *LoadBalancer) queuedKeysLocked() []*APIKey {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	var keys []*APIKey
+	for _, key := range lb.apiKeys {
+		for elem := lb.waiters.Front(); elem != nil; elem = elem.Next() {
+			w := elem.Value.(*waiter)
+			if !w.opts.excludes(key) && key.servesModel(w.opts.Model) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// QueueLength returns the number of callers waiting for a key
+func (lb *LoadBalancer) QueueLength() int {
+	lb.queueMu.Lock()
+	defer lb.queueMu.Unlock()
+
+	return lb.waiters.Len()
+}
+
+// NextAvailableIn estimates how long until any key can serve a request with
+// the given options, counting open circuits and used up quotas as well as
+// rate limits, the key's limit for the model and the tokens to reserve
+func (lb *LoadBalancer) NextAvailableIn(opts AcquireOptions) time.Duration {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	next := time.Duration(-1)
+	for _, key := range lb.apiKeys {
+		// Saturated keys free up when a request is released, not over time
+		if opts.excludes(key) || !key.servesModel(opts.Model) || key.IsDisabled() || key.saturated() {
+			continue
+		}
+		wait := max(
+			key.RateLimiter.TimeUntilNextToken(),
+			key.TokenLimiter.TimeUntilAvailable(opts.Tokens),
+			key.Breaker.RetryIn(),
+			key.Quota.ResetIn(),
+		)
+		if modelLimiter := key.modelLimiter(opts.Model, lb.shared); modelLimiter != nil {
+			wait = max(wait, modelLimiter.TimeUntilNextToken())
+		}
+		if next < 0 || wait < next {
+			next = wait
+		}
+	}
+
+	if next < 0 {
+		return maxDispatchDelay
+	}
+	return next
+}
+
+// notifyWaiters hands out keys to waiting callers after a change that may
+// have made a key available
+func (lb *LoadBalancer) notifyWaiters() {
+	lb.queueMu.Lock()
+	defer lb.queueMu.Unlock()
+
+	lb.dispatchLocked()
+}
+
+// dispatchLocked hands keys to waiters and schedules the next wake-up if
+// anyone is left. Keys are shared fairly between clients: the waiter whose
+// client got the fewest keys since the queue formed goes first, in FIFO order
+// among equals. A waiter that cannot use any available key does not hold up
+// the ones behind it. Must be called with queueMu held.
+func (lb *LoadBalancer) dispatchLocked() {
+	tried := make(map[*list.Element]bool, lb.waiters.Len())
+	for {
+		elem := lb.fairestWaiterLocked(tried)
+		if elem == nil {
+			break
+		}
+		tried[elem] = true
+
+		w := elem.Value.(*waiter)
+		if p, err := lb.selectKey(w.opts); err == nil {
+			lb.waiters.Remove(elem)
+			if lb.served == nil {
+				lb.served = make(map[string]int)
+			}
+			lb.served[w.opts.Client]++
+			w.ready <- p
+		}
+	}
+
+	if lb.waiters.Len() > 0 {
+		lb.scheduleDispatchLocked()
+	} else {
+		lb.served = nil
+	}
+}
+
+// fairestWaiterLocked returns the first waiter not yet tried whose client was
+// served least, or nil when every waiter was tried. Must be called with
+// queueMu held.
+func (lb *LoadBalancer) fairestWaiterLocked(tried map[*list.Element]bool) *list.Element {
+	var best *list.Element
+	bestServed := 0
+	for elem := lb.waiters.Front(); elem != nil; elem = elem.Next() {
+		if tried[elem] {
+			continue
+		}
+		served := lb.served[elem.Value.(*waiter).opts.Client]
+		if best == nil || served < bestServed {
+			best, bestServed = elem, served
+		}
+	}
+	return best
+}
+
+// scheduleDispatchLocked arms the dispatch timer for when the first waiter is
+// expected to be servable. Must be called with queueMu held.
+func (lb *LoadBalancer) scheduleDispatchLocked() {
+	// Waiters for the same model needing the same tokens have the same wait
+	type need struct {
+		model  string
+		tokens int
+	}
+	delay := maxDispatchDelay
+	estimated := make(map[need]bool)
+	for elem := lb.waiters.Front(); elem != nil; elem = elem.Next() {
+		opts := elem.Value.(*waiter).opts
+		if estimated[need{opts.Model, opts.Tokens}] {
+			continue
+		}
+		estimated[need{opts.Model, opts.Tokens}] = true
+		delay = min(delay, lb.NextAvailableIn(AcquireOptions{Model: opts.Model, Tokens: opts.Tokens}))
+	}
+	if delay < minDispatchDelay {
+		delay = minDispatchDelay
+	}
+	if delay > maxDispatchDelay {
+		delay = maxDispatchDelay
+	}
+
+	if lb.dispatchTimer != nil {
+		lb.dispatchTimer.Stop()
+	}
+	lb.dispatchTimer = time.AfterFunc(delay, lb.notifyWaiters)
+}
@@ -0,0 +1,356 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// waitForQueue blocks until the expected number of callers are queued
+func waitForQueue(t *testing.T, lb *LoadBalancer, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for lb.QueueLength() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d queued callers, got %d", n, lb.QueueLength())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLoadBalancer_AcquireFastPath(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+	}
+
+	lb := NewLoadBalancer(cfg)
+
+	key, err := lb.Acquire(context.Background(), AcquireOptions{})
+	if err != nil {
+		t.Fatalf("Failed to acquire key: %v", err)
+	}
+	if key.Key != "key1" {
+		t.Errorf("Expected key1, got %s", key.Key)
+	}
+}
+
+func TestLoadBalancer_AcquireWakesOnRefill(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 60,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	rl := lb.apiKeys[0].RateLimiter
+
+	// Drain the bucket and make the next token due in ~20ms
+	rl.mu.Lock()
+	rl.limiter.Reset(0, time.Now().Add(-980*time.Millisecond))
+	rl.mu.Unlock()
+
+	start := time.Now()
+	if _, err := lb.Acquire(context.Background(), AcquireOptions{}); err != nil {
+		t.Fatalf("Failed to acquire key: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected waiter to be woken at refill, took %v", elapsed)
+	}
+}
+
+func TestLoadBalancer_AcquireFIFO(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 1,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.DisableKey(lb.apiKeys[0], "test")
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := lb.Acquire(context.Background(), AcquireOptions{})
+		first <- err
+	}()
+	waitForQueue(t, lb, 1)
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := lb.Acquire(ctx2, AcquireOptions{})
+		second <- err
+	}()
+	waitForQueue(t, lb, 2)
+
+	// A single token becomes available: it must go to the first waiter
+	if err := lb.EnableKey(0); err != nil {
+		t.Fatalf("Failed to enable key: %v", err)
+	}
+
+	select {
+	case err := <-first:
+		if err != nil {
+			t.Fatalf("First waiter failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("First waiter was not served")
+	}
+
+	waitForQueue(t, lb, 1)
+	cancel2()
+
+	if err := <-second; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected second waiter to be cancelled, got %v", err)
+	}
+	if lb.QueueLength() != 0 {
+		t.Errorf("Expected cancelled waiter to leave the queue, got %d", lb.QueueLength())
+	}
+}
+
+func TestLoadBalancer_AcquireQueueFull(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+		Queue:     config.QueueConfig{MaxDepth: 1},
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.DisableKey(lb.apiKeys[0], "test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go lb.Acquire(ctx, AcquireOptions{})
+	waitForQueue(t, lb, 1)
+
+	if _, err := lb.Acquire(context.Background(), AcquireOptions{}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestLoadBalancer_AcquireTimeout(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+		Queue:     config.QueueConfig{MaxWait: 1},
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.DisableKey(lb.apiKeys[0], "test")
+
+	if _, err := lb.Acquire(context.Background(), AcquireOptions{}); !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Expected ErrQueueTimeout, got %v", err)
+	}
+	if lb.QueueLength() != 0 {
+		t.Errorf("Expected timed out waiter to leave the queue, got %d", lb.QueueLength())
+	}
+}
+
+func TestLoadBalancer_AcquireNoWait(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"key1"},
+		RateLimit: 40,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.DisableKey(lb.apiKeys[0], "test")
+
+	if _, err := lb.Acquire(context.Background(), AcquireOptions{NoWait: true}); !errors.Is(err, ErrKeysExhausted) {
+		t.Errorf("Expected ErrKeysExhausted, got %v", err)
+	}
+	if lb.QueueLength() != 0 {
+		t.Errorf("Expected no waiter to be queued, got %d", lb.QueueLength())
+	}
+}
+
+func TestLoadBalancer_AcquireNoWaitBesideWaiters(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 40,
+		Keys: []config.KeyConfig{
+			{Key: "key1", Models: []string{"a"}},
+			{Key: "key2", Models: []string{"c"}},
+		},
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.DisableKey(lb.apiKeys[1], "test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lb.Acquire(ctx, AcquireOptions{Model: "c"})
+	waitForQueue(t, lb, 1)
+
+	// The queued waiter could not use key1, so it does not hold it up
+	key, err := lb.Acquire(context.Background(), AcquireOptions{Model: "a", NoWait: true})
+	if err != nil {
+		t.Fatalf("Expected the idle key to be handed out, got %v", err)
+	}
+	if key.Key != "key1" {
+		t.Errorf("Expected key1, got %s", key.Key)
+	}
+}
+
+func TestLoadBalancer_AcquireWakesOnRelease(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:        []string{"key1", "key2"},
+		RateLimit:      40,
+		MaxConcurrency: 1,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	ctx := context.Background()
+
+	first, err := lb.Acquire(ctx, AcquireOptions{})
+	if err != nil {
+		t.Fatalf("Failed to acquire key: %v", err)
+	}
+	second, err := lb.Acquire(ctx, AcquireOptions{})
+	if err != nil {
+		t.Fatalf("Failed to acquire key: %v", err)
+	}
+	if first == second {
+		t.Fatalf("Expected a saturated key to be skipped, got %s twice", first.Key)
+	}
+
+	if _, err := lb.Acquire(ctx, AcquireOptions{NoWait: true}); !errors.Is(err, ErrKeysExhausted) {
+		t.Fatalf("Expected ErrKeysExhausted with every key saturated, got %v", err)
+	}
+
+	stats := lb.GetStats()
+	if stats[0].InFlight != 1 || stats[0].MaxConcurrency != 1 {
+		t.Errorf("Expected 1 of 1 in flight, got %d of %d", stats[0].InFlight, stats[0].MaxConcurrency)
+	}
+
+	// A queued caller gets the key as soon as its request finishes
+	got := make(chan *APIKey, 1)
+	go func() {
+		key, _ := lb.Acquire(ctx, AcquireOptions{})
+		got <- key
+	}()
+	waitForQueue(t, lb, 1)
+
+	lb.Release(first)
+	select {
+	case key := <-got:
+		if key != first {
+			t.Errorf("Expected the released key, got %v", key)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Expected the queued caller to get the released key")
+	}
+}
+
+func TestLoadBalancer_AcquireFairShare(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:        []string{"key1"},
+		RateLimit:      100,
+		MaxConcurrency: 1,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	ctx := context.Background()
+
+	held, err := lb.Acquire(ctx, AcquireOptions{})
+	if err != nil {
+		t.Fatalf("Failed to acquire key: %v", err)
+	}
+
+	// A batch job queues up before an interactive user
+	served := make(chan string, 4)
+	enqueue := func(client string) {
+		go func() {
+			if _, err := lb.Acquire(ctx, AcquireOptions{Client: client}); err == nil {
+				served <- client
+			}
+		}()
+	}
+	for i := 1; i <= 3; i++ {
+		enqueue("batch")
+		waitForQueue(t, lb, i)
+	}
+	enqueue("interactive")
+	waitForQueue(t, lb, 4)
+
+	// Hand the key over one request at a time
+	var order []string
+	for i := 0; i < 3; i++ {
+		lb.Release(held)
+		select {
+		case client := <-served:
+			order = append(order, client)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a waiter to be served, got %v", order)
+		}
+	}
+
+	// The interactive user does not wait behind the whole batch
+	if order[0] != "batch" || order[1] != "interactive" || order[2] != "batch" {
+		t.Errorf("Expected batch, interactive, batch, got %v", order)
+	}
+}
+
+func TestLoadBalancer_NextAvailableInOpenCircuit(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:        []string{"key1"},
+		RateLimit:      60,
+		CircuitBreaker: config.CircuitBreakerConfig{FailureThreshold: 1, Cooldown: 30},
+	}
+
+	lb := NewLoadBalancer(cfg)
+	lb.MarkKeyError(lb.apiKeys[0])
+
+	if wait := lb.NextAvailableIn(AcquireOptions{}); wait <= 29*time.Second || wait > 30*time.Second {
+		t.Errorf("Expected to wait for the cooldown, got %v", wait)
+	}
+}
+
+func TestLoadBalancer_NextAvailableInTokens(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:         []string{"key1"},
+		RateLimit:       60,
+		TokensPerMinute: 600,
+	}
+
+	lb := NewLoadBalancer(cfg)
+	if !lb.apiKeys[0].TokenLimiter.TryReserve(600) {
+		t.Fatal("Failed to reserve the whole token budget")
+	}
+
+	// 600 tokens per minute refill 10 per second
+	wait := lb.NextAvailableIn(AcquireOptions{Tokens: 300})
+	if wait <= 29*time.Second || wait > 30*time.Second {
+		t.Errorf("Expected to wait 30s for 300 tokens, got %v", wait)
+	}
+	if wait := lb.NextAvailableIn(AcquireOptions{Tokens: 10}); wait > time.Second {
+		t.Errorf("Expected to wait about 1s for 10 tokens, got %v", wait)
+	}
+}
+
+func TestLoadBalancer_NextAvailableInModelLimit(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:     []string{"key1"},
+		RateLimit:   60,
+		ModelLimits: []config.ModelLimitConfig{{Model: "heavy", RateLimit: 2}},
+	}
+
+	lb := NewLoadBalancer(cfg)
+	for i := 0; i < 2; i++ {
+		if _, err := lb.Acquire(context.Background(), AcquireOptions{Model: "heavy", NoWait: true}); err != nil {
+			t.Fatalf("Failed to acquire key: %v", err)
+		}
+	}
+
+	// The model's limit refills one request every 30s, the key's every second
+	if wait := lb.NextAvailableIn(AcquireOptions{Model: "heavy"}); wait <= 29*time.Second || wait > 30*time.Second {
+		t.Errorf("Expected to wait 30s for the heavy model, got %v", wait)
+	}
+	if wait := lb.NextAvailableIn(AcquireOptions{Model: "cheap"}); wait != 0 {
+		t.Errorf("Expected no wait for another model, got %v", wait)
+	}
+}
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// Quota tracks the daily and monthly requests and tokens used by an API key
+// against its configured budget. Windows reset at midnight and on the first
+// of the month in the configured timezone.
+type Quota struct {
+	limits config.QuotaConfig
+	loc    *time.Location
+
+	day           string // current daily window, e.g. 2024-01-08
+	month         string // current monthly window, e.g. 2024-01
+	dayRequests   int64
+	dayTokens     int64
+	monthRequests int64
+	monthTokens   int64
+	mu            sync.Mutex
+}
+
+// QuotaStats reports the budget left in the current windows. Unlimited
+// values are -1.
+type QuotaStats struct {
+	RequestsLeftToday     int64
+	TokensLeftToday       int64
+	RequestsLeftThisMonth int64
+	TokensLeftThisMonth   int64
+	DayResetsAt           time.Time
+	MonthResetsAt         time.Time
+}
+
+// NewQuota creates a quota tracker for the given limits
+func NewQuota(cfg config.QuotaConfig) *Quota {
+	return &Quota{limits: cfg, loc: cfg.Location()}
+}
+
+// Configure changes the limits, keeping what was used in the current windows
+func (q *Quota) Configure(cfg config.QuotaConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.limits = cfg
+	q.loc = cfg.Location()
+}
+
+// Exhausted reports whether any daily or monthly budget is used up
+func (q *Quota) Exhausted() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.limits.Enabled() {
+		return false
+	}
+
+	q.roll(time.Now())
+	return reached(q.dayRequests, q.limits.RequestsPerDay) ||
+		reached(q.dayTokens, q.limits.TokensPerDay) ||
+		reached(q.monthRequests, q.limits.RequestsPerMonth) ||
+		reached(q.monthTokens, q.limits.TokensPerMonth)
+}
+
+// ResetIn returns how long until an exhausted budget resets, 0 when none is
+// exhausted
+func (q *Quota) ResetIn() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.limits.Enabled() {
+		return 0
+	}
+
+	now := time.Now().In(q.loc)
+	q.roll(now)
+	switch {
+	case reached(q.monthRequests, q.limits.RequestsPerMonth) || reached(q.monthTokens, q.limits.TokensPerMonth):
+		firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, q.loc)
+		return firstOfMonth.AddDate(0, 1, 0).Sub(now)
+	case reached(q.dayRequests, q.limits.RequestsPerDay) || reached(q.dayTokens, q.limits.TokensPerDay):
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, q.loc)
+		return midnight.AddDate(0, 0, 1).Sub(now)
+	default:
+		return 0
+	}
+}
+
+// AddRequest counts a request against the budget
+func (q *Quota) AddRequest() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(time.Now())
+	q.dayRequests++
+	q.monthRequests++
+}
+
+// AddTokens counts the tokens a request used against the budget
+func (q *Quota) AddTokens(tokens int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.roll(time.Now())
+	q.dayTokens += int64(tokens)
+	q.monthTokens += int64(tokens)
+}
+
+// Stats returns the remaining budget, or nil when no quota is configured
+func (q *Quota) Stats() *QuotaStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.limits.Enabled() {
+		return nil
+	}
+
+	now := time.Now().In(q.loc)
+	q.roll(now)
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, q.loc)
+	firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, q.loc)
+	return &QuotaStats{
+		RequestsLeftToday:     remaining(q.dayRequests, q.limits.RequestsPerDay),
+		TokensLeftToday:       remaining(q.dayTokens, q.limits.TokensPerDay),
+		RequestsLeftThisMonth: remaining(q.monthRequests, q.limits.RequestsPerMonth),
+		TokensLeftThisMonth:   remaining(q.monthTokens, q.limits.TokensPerMonth),
+		DayResetsAt:           midnight.AddDate(0, 0, 1),
+		MonthResetsAt:         firstOfMonth.AddDate(0, 1, 0),
+	}
+}
+
+// roll starts new windows when the day or month has changed. Must be called
+// with the lock held.
+func (q *Quota) roll(now time.Time) {
+	now = now.In(q.loc)
+
+	if day := now.Format("2006-01-02"); day != q.day {
+		q.day = day
+		q.dayRequests = 0
+		q.dayTokens = 0
+	}
+	if month := now.Format("2006-01"); month != q.month {
+		q.month = month
+		q.monthRequests = 0
+		q.monthTokens = 0
+	}
+}
+
+// reached reports whether used has hit a limit, 0 meaning no limit
+func reached(used int64, limit int) bool {
+	return limit > 0 && used >= int64(limit)
+}
+
+// remaining returns what is left of a limit, -1 meaning no limit
+func remaining(used int64, limit int) int64 {
+	if limit <= 0 {
+		return -1
+	}
+	if left := int64(limit) - used; left > 0 {
+		return left
+	}
+	return 0
+}
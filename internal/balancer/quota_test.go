@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+func TestQuota_RequestsPerDay(t *testing.T) {
+	q := NewQuota(config.QuotaConfig{RequestsPerDay: 2})
+
+	for i := 0; i < 2; i++ {
+		if q.Exhausted() {
+			t.Fatalf("Quota exhausted after %d requests", i)
+		}
+		q.AddRequest()
+	}
+	if !q.Exhausted() {
+		t.Error("Expected quota to be exhausted after 2 requests")
+	}
+
+	// The daily budget resets with the day
+	q.mu.Lock()
+	q.day = "2000-01-01"
+	q.mu.Unlock()
+
+	if q.Exhausted() {
+		t.Error("Expected quota to reset on a new day")
+	}
+}
+
+func TestQuota_ResetIn(t *testing.T) {
+	q := NewQuota(config.QuotaConfig{RequestsPerDay: 1, RequestsPerMonth: 2})
+	if wait := q.ResetIn(); wait != 0 {
+		t.Errorf("Expected no wait before the budget is used, got %v", wait)
+	}
+
+	q.AddRequest()
+	if wait := q.ResetIn(); wait <= 0 || wait > 24*time.Hour {
+		t.Errorf("Expected to wait until midnight, got %v", wait)
+	}
+
+	// With the monthly budget used up too, the next day does not help
+	q.mu.Lock()
+	q.monthRequests = 2
+	q.mu.Unlock()
+	now := time.Now().UTC()
+	firstOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0)
+	if wait := q.ResetIn(); wait > firstOfMonth.Sub(now) || wait < firstOfMonth.Sub(now)-time.Second {
+		t.Errorf("Expected to wait until the first of the month, got %v", wait)
+	}
+}
+
+func TestQuota_TokensPerMonth(t *testing.T) {
+	q := NewQuota(config.QuotaConfig{TokensPerDay: 10000, TokensPerMonth: 1000})
+
+	q.AddTokens(600)
+	if q.Exhausted() {
+		t.Fatal("Quota exhausted before the monthly budget was used")
+	}
+	q.AddTokens(600)
+	if !q.Exhausted() {
+		t.Error("Expected quota to be exhausted after the monthly budget")
+	}
+
+	// A new day does not reset the monthly budget
+	q.mu.Lock()
+	q.day = "2000-01-01"
+	q.mu.Unlock()
+	if !q.Exhausted() {
+		t.Error("Expected the monthly budget to outlast the day")
+	}
+
+	stats := q.Stats()
+	if stats.TokensLeftToday != 10000 || stats.TokensLeftThisMonth != 0 || stats.RequestsLeftToday != -1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestQuota_Timezone(t *testing.T) {
+	q := NewQuota(config.QuotaConfig{RequestsPerDay: 10, Timezone: "Asia/Tokyo"})
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("Timezone data not available: %v", err)
+	}
+
+	stats := q.Stats()
+	reset := stats.DayResetsAt.In(tokyo)
+	if reset.Hour() != 0 || reset.Minute() != 0 {
+		t.Errorf("Expected the day to reset at midnight Tokyo time, got %s", reset)
+	}
+	if until := time.Until(reset); until <= 0 || until > 24*time.Hour {
+		t.Errorf("Expected the next reset within a day, got %s", until)
+	}
+	if q.day != time.Now().In(tokyo).Format("2006-01-02") {
+		t.Errorf("Expected the window to follow the Tokyo date, got %s", q.day)
+	}
+}
+
+func TestQuota_Unlimited(t *testing.T) {
+	q := NewQuota(config.QuotaConfig{})
+
+	q.AddRequest()
+	q.AddTokens(1_000_000)
+	if q.Exhausted() {
+		t.Error("Expected no quota to never be exhausted")
+	}
+	if q.Stats() != nil {
+		t.Error("Expected no stats without a quota")
+	}
+}
@@ -1,85 +1,331 @@
 package balancer
 
 import (
+	"context"
 	"sync"
 	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
 )
 
-// RateLimiter implements a token bucket rate limiter for an API key
+// RateLimiter limits the requests of an API key with a Limiter algorithm.
+// The limiter is kept in memory unless it is shared through a backend, in
+// which case the local limiter is only used while the backend is unreachable.
 type RateLimiter struct {
-	tokens     int
-	maxTokens  int
-	refillRate int // tokens per minute
-	lastRefill time.Time
-	mu         sync.Mutex
+	limiter   Limiter
+	algorithm string
+	limit     int       // requests per minute
+	pausedTil time.Time // set when upstream asks us to back off
+	clock     Clock
+	mu        sync.Mutex
+
+	shared   RateLimiterBackend // nil when limiting locally only
+	bucket   string             // name of the bucket in the shared backend
+	seen     Limiter            // the shared bucket as last reported, refilling since
+	fallback bool               // the backend failed last time, so the local limiter applies
 }
 
-// NewRateLimiter creates a new rate limiter
+// NewRateLimiter creates a token bucket rate limiter allowing a minute's
+// worth of requests at once
 func NewRateLimiter(rateLimit int) *RateLimiter {
+	return newRateLimiter(config.LimiterTokenBucket, rateLimit, 0, time.Now)
+}
+
+// newRateLimiter creates a rate limiter using the named algorithm
+func newRateLimiter(algorithm string, rateLimit, burst int, clock Clock) *RateLimiter {
+	if algorithm == "" {
+		algorithm = config.LimiterTokenBucket
+	}
 	return &RateLimiter{
-		tokens:     rateLimit,
-		maxTokens:  rateLimit,
-		refillRate: rateLimit,
-		lastRefill: time.Now(),
+		limiter:   NewLimiter(algorithm, rateLimit, burst, clock),
+		algorithm: algorithm,
+		limit:     rateLimit,
+		clock:     clock,
+	}
+}
+
+// Share keeps the limiter's bucket in a shared backend under the given name
+func (rl *RateLimiter) Share(backend RateLimiterBackend, bucket string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.shared = backend
+	rl.bucket = bucket
+	if rl.seen == nil {
+		rl.seen = NewLimiter(config.LimiterTokenBucket, rl.limit, 0, rl.clock)
+	}
+}
+
+// reserve takes a request without waiting for a shared backend, so it may be
+// called with the load balancer's locks held. A shared bucket is only
+// reserved from as last reported, and pending reports that the request must
+// still be taken from it with takeShared.
+func (rl *RateLimiter) reserve() (ok, pending bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	switch {
+	case rl.paused(rl.clock()):
+		return false, false
+	case rl.shared == nil:
+		return rl.limiter.TryAcquire(), false
+	case rl.fallback:
+		// takeShared takes from the local limiter if the backend still fails
+		return rl.limiter.Available() > 0, true
+	default:
+		return rl.seen.TryAcquire(), true
+	}
+}
+
+// takeShared takes a request reserved with reserve from the shared buckets
+// of the limiters, from all of them or none, in one call to their backend.
+// The local limiters apply while the backend is unreachable. It waits for the
+// backend, so it must not be called with the load balancer's locks held.
+func takeShared(limiters []*RateLimiter) bool {
+	var backend RateLimiterBackend
+	buckets := make([]Bucket, len(limiters))
+	for i, rl := range limiters {
+		rl.mu.Lock()
+		backend, buckets[i] = rl.shared, Bucket{Name: rl.bucket, Limit: rl.limit}
+		rl.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+
+	states, err := backend.Take(ctx, buckets, 1)
+	if err != nil {
+		return takeLocal(limiters)
 	}
+	for i, rl := range limiters {
+		rl.observe(states[i])
+	}
+	return states[0].Allowed
+}
+
+// takeLocal takes a request from the local limiters, from all of them or
+// none, while their shared backend is unreachable
+func takeLocal(limiters []*RateLimiter) bool {
+	for i, rl := range limiters {
+		rl.mu.Lock()
+		rl.fallback = true
+		ok := rl.limiter.TryAcquire()
+		rl.mu.Unlock()
+
+		if !ok {
+			for _, taken := range limiters[:i] {
+				taken.mu.Lock()
+				taken.limiter.Refund()
+				taken.mu.Unlock()
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// observe records the state of the shared bucket reported by the backend
+func (rl *RateLimiter) observe(state BucketState) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.fallback = false
+	now := rl.clock()
+	if state.Remaining > 0 {
+		rl.seen.Reset(state.Remaining, now)
+		return
+	}
+	// The next request is due after the wait, which is an interval after
+	// the bucket started refilling it
+	rl.seen.Reset(0, now.Add(state.Wait-limitInterval(rl.limit)))
+}
+
+// setShared overrides the shared bucket, if any. The local bucket is always
+// updated too, so it is accurate should the backend become unreachable.
+func (rl *RateLimiter) setShared(tokens int, from time.Time) {
+	rl.mu.Lock()
+	shared, bucket := rl.shared, rl.bucket
+	rl.mu.Unlock()
+
+	if shared == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+
+	shared.Set(ctx, bucket, tokens, from)
 }
 
 // TryAcquire attempts to acquire a token, returns true if successful
 func (rl *RateLimiter) TryAcquire() bool {
+	ok, pending := rl.reserve()
+	if ok && pending {
+		return takeShared([]*RateLimiter{rl})
+	}
+	return ok
+}
+
+// refund gives back a request from reserve that went unused
+func (rl *RateLimiter) refund() {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	rl.refill()
+	switch {
+	case rl.shared == nil:
+		rl.limiter.Refund()
+	case !rl.fallback:
+		rl.seen.Refund()
+	}
+}
+
+// SetLimit changes the requests per minute, allowing as many at once
+func (rl *RateLimiter) SetLimit(rateLimit int) {
+	rl.mu.Lock()
+	algorithm := rl.algorithm
+	rl.mu.Unlock()
+
+	rl.configure(algorithm, rateLimit, 0)
+}
+
+// configure changes the algorithm, requests per minute and burst. A new
+// algorithm starts with the requests the old one had available.
+func (rl *RateLimiter) configure(algorithm string, rateLimit, burst int) {
+	if algorithm == "" {
+		algorithm = config.LimiterTokenBucket
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-	if rl.tokens > 0 {
-		rl.tokens--
-		return true
+	rl.limit = rateLimit
+	if rl.seen != nil {
+		rl.seen.SetLimit(rateLimit, rateLimit)
+	}
+	if algorithm == rl.algorithm {
+		rl.limiter.SetLimit(rateLimit, burstFor(rateLimit, burst))
+		return
 	}
 
-	return false
+	available := rl.limiter.Available()
+	rl.limiter = NewLimiter(algorithm, rateLimit, burst, rl.clock)
+	rl.limiter.Reset(available, rl.clock())
+	rl.algorithm = algorithm
 }
 
-// refill adds tokens based on elapsed time
-func (rl *RateLimiter) refill() {
-	now := time.Now()
-	elapsed := now.Sub(rl.lastRefill)
+// PauseUntil drains the bucket and stops handing out tokens until the given
+// time, e.g. when upstream answered 429 with Retry-After
+func (rl *RateLimiter) PauseUntil(until time.Time) {
+	rl.mu.Lock()
+	if until.Before(rl.pausedTil) {
+		rl.mu.Unlock()
+		return
+	}
 
-	// Refill tokens based on elapsed minutes
-	tokensToAdd := int(elapsed.Minutes() * float64(rl.refillRate))
+	rl.reset(0, until)
+	rl.pausedTil = until
+	rl.mu.Unlock()
 
-	if tokensToAdd > 0 {
-		rl.tokens += tokensToAdd
-		if rl.tokens > rl.maxTokens {
-			rl.tokens = rl.maxTokens
-		}
-		rl.lastRefill = now
+	rl.setShared(0, until)
+}
+
+// Sync aligns the bucket with the remaining quota reported by upstream. When
+// nothing is left the limiter is paused until the reported reset time.
+func (rl *RateLimiter) Sync(remaining int, reset time.Time) {
+	rl.mu.Lock()
+
+	now := rl.clock()
+	if remaining <= 0 && reset.After(now) {
+		rl.reset(0, reset)
+		rl.pausedTil = reset
+		rl.mu.Unlock()
+
+		rl.setShared(0, reset)
+		return
 	}
+
+	remaining = max(remaining, 0)
+	rl.reset(remaining, now)
+	remaining = rl.limiter.Available()
+	rl.mu.Unlock()
+
+	rl.setShared(remaining, now)
 }
 
-// AvailableTokens returns the current number of available tokens
+// reset sets the requests available in the local limiter and the shared
+// bucket as last seen. Must be called with the lock held.
+func (rl *RateLimiter) reset(available int, at time.Time) {
+	rl.limiter.Reset(available, at)
+	if rl.seen != nil {
+		rl.seen.Reset(available, at)
+	}
+}
+
+// current returns the limiter requests are counted by: the shared bucket as
+// last seen, or the local limiter. Must be called with the lock held.
+func (rl *RateLimiter) current() Limiter {
+	if rl.shared != nil && !rl.fallback {
+		return rl.seen
+	}
+	return rl.limiter
+}
+
+// paused reports whether upstream asked us to hold off. Must be called with the lock held.
+func (rl *RateLimiter) paused(now time.Time) bool {
+	return now.Before(rl.pausedTil)
+}
+
+// AvailableTokens returns the current number of available tokens. A shared
+// bucket is reported as last seen, without asking the backend.
 func (rl *RateLimiter) AvailableTokens() int {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	rl.refill()
-	return rl.tokens
+	if rl.paused(rl.clock()) {
+		return 0
+	}
+	return rl.current().Available()
 }
 
-// TimeUntilNextToken returns the duration until the next token is available
+// TimeUntilNextToken returns the duration until the next token is available.
+// A shared bucket is reported as last seen, without asking the backend.
 func (rl *RateLimiter) TimeUntilNextToken() time.Duration {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	rl.refill()
+	if pausedFor := rl.pausedTil.Sub(rl.clock()); pausedFor > 0 {
+		return pausedFor
+	}
+	return rl.current().Wait()
+}
 
-	if rl.tokens > 0 {
-		return 0
+// Algorithm returns the name of the rate limit algorithm
+func (rl *RateLimiter) Algorithm() string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.algorithm
+}
+
+// snapshot returns the requests available, the time they were counted at,
+// which is the end of any pause, and the pause
+func (rl *RateLimiter) snapshot() (tokens int, at, pausedUntil time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	at = rl.clock()
+	if rl.pausedTil.After(at) {
+		at = rl.pausedTil
 	}
+	return rl.limiter.Available(), at, rl.pausedTil
+}
 
-	// Calculate time until next token
-	tokensNeeded := 1
-	minutesNeeded := float64(tokensNeeded) / float64(rl.refillRate)
-	durationNeeded := time.Duration(minutesNeeded * float64(time.Minute))
+// restore puts back a snapshot. The limiter refills from the time the
+// requests were counted at, so time since then still counts.
+func (rl *RateLimiter) restore(tokens int, at, pausedUntil time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-	return durationNeeded
+	rl.limiter.Reset(tokens, at)
+	rl.pausedTil = pausedUntil
 }
@@ -3,6 +3,8 @@ package balancer
 import (
 	"testing"
 	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
 )
 
 func TestRateLimiter_TryAcquire(t *testing.T) {
@@ -24,7 +26,8 @@ func TestRateLimiter_TryAcquire(t *testing.T) {
 
 func TestRateLimiter_Refill(t *testing.T) {
 	// Create a rate limiter with 1 token per minute
-	rl := NewRateLimiter(1)
+	clock := newFakeClock()
+	rl := newRateLimiter(config.LimiterTokenBucket, 1, 0, clock.Now)
 
 	// Acquire the only token
 	if !rl.TryAcquire() {
@@ -36,8 +39,7 @@ func TestRateLimiter_Refill(t *testing.T) {
 		t.Error("Should not be able to acquire token immediately")
 	}
 
-	// Manually set lastRefill to 1 minute ago
-	rl.lastRefill = time.Now().Add(-1 * time.Minute)
+	clock.Advance(time.Minute)
 
 	// Should be able to acquire a token after refill
 	if !rl.TryAcquire() {
@@ -80,3 +82,59 @@ func TestRateLimiter_TimeUntilNextToken(t *testing.T) {
 		t.Error("Should need to wait for next token")
 	}
 }
+
+func TestRateLimiter_PauseUntil(t *testing.T) {
+	clock := newFakeClock()
+	rl := newRateLimiter(config.LimiterTokenBucket, 10, 0, clock.Now)
+
+	rl.PauseUntil(clock.Now().Add(time.Minute))
+
+	if rl.TryAcquire() {
+		t.Error("Should not acquire tokens while paused")
+	}
+	if tokens := rl.AvailableTokens(); tokens != 0 {
+		t.Errorf("Expected 0 tokens while paused, got %d", tokens)
+	}
+	if wait := rl.TimeUntilNextToken(); wait < 59*time.Second {
+		t.Errorf("Expected to wait out the pause, got %v", wait)
+	}
+
+	// An earlier pause must not shorten the current one
+	rl.PauseUntil(clock.Now().Add(time.Second))
+	if wait := rl.TimeUntilNextToken(); wait < 59*time.Second {
+		t.Errorf("Expected pause to be kept, got %v", wait)
+	}
+
+	// Once the pause is over tokens refill from the pause end
+	clock.Advance(time.Minute)
+	if rl.TryAcquire() {
+		t.Error("Should not acquire tokens before any refilled after the pause")
+	}
+	clock.Advance(6 * time.Second)
+	if !rl.TryAcquire() {
+		t.Error("Should acquire tokens after pause expired")
+	}
+}
+
+func TestRateLimiter_Sync(t *testing.T) {
+	rl := NewRateLimiter(10)
+
+	rl.Sync(4, time.Now().Add(time.Minute))
+	if tokens := rl.AvailableTokens(); tokens != 4 {
+		t.Errorf("Expected 4 tokens after sync, got %d", tokens)
+	}
+
+	// Upstream may report more than our local maximum
+	rl.Sync(100, time.Now().Add(time.Minute))
+	if tokens := rl.AvailableTokens(); tokens != 10 {
+		t.Errorf("Expected tokens capped at 10, got %d", tokens)
+	}
+
+	rl.Sync(0, time.Now().Add(30*time.Second))
+	if rl.TryAcquire() {
+		t.Error("Should not acquire tokens when upstream reports none remaining")
+	}
+	if wait := rl.TimeUntilNextToken(); wait < 29*time.Second {
+		t.Errorf("Expected to wait until reset, got %v", wait)
+	}
+}
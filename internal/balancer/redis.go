@@ -0,0 +1,181 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrBackendUnavailable is returned while a shared backend that recently
+// failed is skipped
+var ErrBackendUnavailable = errors.New("shared rate limit store unavailable")
+
+// redisRetryInterval is how long a failed Redis store is skipped before it
+// is tried again
+const redisRetryInterval = 5 * time.Second
+
+// takeScript refills buckets and takes from all of them or none in one
+// atomic step. A bucket is a hash of its tokens and the time in milliseconds
+// it was last refilled, which lies in the future while the bucket is paused.
+// It returns whether the tokens were taken, then the tokens left and the
+// wait of every bucket.
+var takeScript = redis.NewScript(`
+local n = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+
+local allowed = n > 0
+local buckets = {}
+for i, key in ipairs(KEYS) do
+  local limit = tonumber(ARGV[i + 2])
+  local state = redis.call('HMGET', key, 'tokens', 'ts')
+  local tokens = tonumber(state[1])
+  local ts = tonumber(state[2])
+  if tokens == nil or ts == nil then
+    tokens = limit
+    ts = now
+  end
+
+  local paused = now < ts
+  if not paused then
+    tokens = math.min(limit, tokens + (now - ts) * limit / 60000)
+  end
+  if paused or tokens < n then
+    allowed = false
+  end
+  buckets[i] = {limit = limit, tokens = tokens, ts = ts, paused = paused}
+end
+
+local result = {allowed and 1 or 0}
+for i, key in ipairs(KEYS) do
+  local b = buckets[i]
+  if b.paused then
+    table.insert(result, 0)
+    table.insert(result, b.ts - now)
+  else
+    if allowed then
+      b.tokens = b.tokens - n
+    end
+    redis.call('HSET', key, 'tokens', tostring(b.tokens), 'ts', tostring(now))
+    redis.call('PEXPIRE', key, 120000)
+
+    local wait = 0
+    if b.tokens < 1 then
+      wait = math.ceil((1 - b.tokens) * 60000 / b.limit)
+    end
+    table.insert(result, math.floor(b.tokens))
+    table.insert(result, wait)
+  end
+end
+return result
+`)
+
+// RedisBackend shares rate limiter buckets between proxy replicas through a
+// Redis-compatible store. Bucket names are prefixed so several deployments
+// can use the same store.
+type RedisBackend struct {
+	client *redis.Client
+	prefix string
+
+	retryAt atomic.Int64 // unix nanoseconds before which the store is skipped
+}
+
+// NewRedisBackend connects to the Redis server at addr
+func NewRedisBackend(addr, password string, db int, prefix string) *RedisBackend {
+	return &RedisBackend{
+		client: redis.NewClient(&redis.Options{
+			Addr:        addr,
+			Password:    password,
+			DB:          db,
+			DialTimeout: sharedTimeout,
+			MaxRetries:  -1, // fall back to local limiting instead
+		}),
+		prefix: prefix,
+	}
+}
+
+// Take implements RateLimiterBackend
+func (rb *RedisBackend) Take(ctx context.Context, buckets []Bucket, n int) ([]BucketState, error) {
+	if err := rb.available(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(buckets))
+	args := []interface{}{n, time.Now().UnixMilli()}
+	for i, bucket := range buckets {
+		keys[i] = rb.key(bucket.Name)
+		args = append(args, bucket.Limit)
+	}
+
+	res, err := takeScript.Run(ctx, rb.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, rb.failed(err)
+	}
+	rb.recovered()
+
+	states := make([]BucketState, len(buckets))
+	for i := range states {
+		states[i] = BucketState{
+			Allowed:   res[0] == 1,
+			Remaining: int(res[1+2*i]),
+			Wait:      time.Duration(res[2+2*i]) * time.Millisecond,
+		}
+	}
+	return states, nil
+}
+
+// Set implements RateLimiterBackend
+func (rb *RedisBackend) Set(ctx context.Context, bucket string, tokens int, from time.Time) error {
+	if err := rb.available(); err != nil {
+		return err
+	}
+
+	key := rb.key(bucket)
+	ttl := time.Until(from) + 2*time.Minute
+	_, err := rb.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "tokens", tokens, "ts", from.UnixMilli())
+		pipe.PExpire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		return rb.failed(err)
+	}
+	rb.recovered()
+	return nil
+}
+
+// Close closes the connections to the store
+func (rb *RedisBackend) Close() error {
+	return rb.client.Close()
+}
+
+// key returns the Redis key holding a bucket
+func (rb *RedisBackend) key(bucket string) string {
+	return rb.prefix + ":ratelimit:" + bucket
+}
+
+// available fails fast while the store is being skipped after an error
+func (rb *RedisBackend) available() error {
+	if time.Now().UnixNano() < rb.retryAt.Load() {
+		return ErrBackendUnavailable
+	}
+	return nil
+}
+
+// failed starts skipping the store after an error
+func (rb *RedisBackend) failed(err error) error {
+	if rb.retryAt.Swap(time.Now().Add(redisRetryInterval).UnixNano()) == 0 {
+		log.Printf("Shared rate limit store failed, limiting locally: %v", err)
+	}
+	return err
+}
+
+// recovered stops skipping the store after it answered again
+func (rb *RedisBackend) recovered() {
+	if rb.retryAt.Swap(0) != 0 {
+		log.Printf("Shared rate limit store is back, sharing rate limits again")
+	}
+}
@@ -0,0 +1,184 @@
+package balancer
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// newReplica creates a rate limiter as another proxy replica would
+func newReplica(t *testing.T, server *miniredis.Miniredis, rateLimit int) *RateLimiter {
+	t.Helper()
+
+	backend := NewRedisBackend(server.Addr(), "", 0, "test")
+	t.Cleanup(func() { backend.Close() })
+
+	rl := NewRateLimiter(rateLimit)
+	rl.Share(backend, "key1")
+	return rl
+}
+
+func TestRedisBackend_SharesBucket(t *testing.T) {
+	server := miniredis.RunT(t)
+	a, b := newReplica(t, server, 5), newReplica(t, server, 5)
+
+	acquired := 0
+	for i := 0; i < 5; i++ {
+		for _, rl := range []*RateLimiter{a, b} {
+			if rl.TryAcquire() {
+				acquired++
+			}
+		}
+	}
+	if acquired != 5 {
+		t.Errorf("Expected replicas to share 5 tokens, acquired %d", acquired)
+	}
+
+	if tokens := b.AvailableTokens(); tokens != 0 {
+		t.Errorf("Expected shared bucket to be empty, got %d", tokens)
+	}
+	if wait := a.TimeUntilNextToken(); wait <= 0 || wait > 12*time.Second {
+		t.Errorf("Expected to wait about 12s for the next token, got %s", wait)
+	}
+}
+
+func TestRedisBackend_SharesPause(t *testing.T) {
+	server := miniredis.RunT(t)
+	a, b := newReplica(t, server, 40), newReplica(t, server, 40)
+
+	// Upstream asked replica a to back off; replica b must honour it too
+	a.PauseUntil(time.Now().Add(time.Minute))
+
+	if b.TryAcquire() {
+		t.Error("Expected the pause to apply to every replica")
+	}
+	if wait := b.TimeUntilNextToken(); wait < 55*time.Second {
+		t.Errorf("Expected to wait for the pause, got %s", wait)
+	}
+}
+
+func TestRedisBackend_FallsBackToLocal(t *testing.T) {
+	server := miniredis.RunT(t)
+	rl := newReplica(t, server, 2)
+
+	if !rl.TryAcquire() {
+		t.Fatal("Failed to acquire from the shared bucket")
+	}
+
+	server.Close()
+
+	// The local bucket takes over while the store is unreachable
+	for i := 0; i < 2; i++ {
+		if !rl.TryAcquire() {
+			t.Errorf("Expected local limiting to allow request %d", i+1)
+		}
+	}
+	if rl.TryAcquire() {
+		t.Error("Expected local limiting to still enforce the rate limit")
+	}
+}
+
+func TestLoadBalancer_ShareRateLimits(t *testing.T) {
+	server := miniredis.RunT(t)
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"nvapi-key-0001"},
+		RateLimit: 3,
+	}
+
+	replicas := make([]*LoadBalancer, 2)
+	for i := range replicas {
+		backend := NewRedisBackend(server.Addr(), "", 0, "test")
+		t.Cleanup(func() { backend.Close() })
+
+		replicas[i] = NewLoadBalancer(cfg)
+		replicas[i].ShareRateLimits(backend)
+	}
+
+	acquired := 0
+	for i := 0; i < 3; i++ {
+		for _, lb := range replicas {
+			if _, err := lb.GetNextKey(); err == nil {
+				acquired++
+			}
+		}
+	}
+	if acquired != 3 {
+		t.Errorf("Expected replicas to share the key's 3 requests, acquired %d", acquired)
+	}
+
+	for _, k := range server.Keys() {
+		if k != "test:ratelimit:"+hashKey("nvapi-key-0001") {
+			t.Errorf("Unexpected key in the store: %s", k)
+		}
+	}
+}
+
+func TestRedisBackend_TakesFromAllOrNone(t *testing.T) {
+	server := miniredis.RunT(t)
+	backend := NewRedisBackend(server.Addr(), "", 0, "test")
+	t.Cleanup(func() { backend.Close() })
+
+	ctx := context.Background()
+	buckets := []Bucket{{Name: "model", Limit: 1}, {Name: "key", Limit: 5}}
+	if states, err := backend.Take(ctx, buckets, 1); err != nil || !states[0].Allowed {
+		t.Fatalf("Failed to take from both buckets: %v", err)
+	}
+
+	// The model bucket is empty, so the key bucket must not be taken from
+	states, err := backend.Take(ctx, buckets, 1)
+	if err != nil {
+		t.Fatalf("Failed to take: %v", err)
+	}
+	if states[0].Allowed || states[0].Remaining != 0 || states[1].Remaining != 4 {
+		t.Errorf("Expected nothing taken with the model bucket empty, got %+v", states)
+	}
+}
+
+func TestLoadBalancer_SharedStatsFromLastSeen(t *testing.T) {
+	server := miniredis.RunT(t)
+	backend := NewRedisBackend(server.Addr(), "", 0, "test")
+	t.Cleanup(func() { backend.Close() })
+
+	lb := NewLoadBalancer(&config.NVIDIAConfig{
+		APIKeys:   []string{"key1", "key2"},
+		RateLimit: 10,
+		Strategy:  config.StrategyMostTokensRemaining,
+	})
+	lb.ShareRateLimits(backend)
+	if _, err := lb.GetNextKey(); err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+
+	// Stats, estimates and strategies read the buckets as last seen
+	commands := server.CommandCount()
+	stats := lb.GetStats()
+	lb.NextAvailableIn(AcquireOptions{})
+	if got := server.CommandCount() - commands; got != 0 {
+		t.Errorf("Expected no calls to the store, got %d", got)
+	}
+	if stats[0].AvailableTokens+stats[1].AvailableTokens != 19 {
+		t.Errorf("Expected 19 requests left, got %d and %d", stats[0].AvailableTokens, stats[1].AvailableTokens)
+	}
+
+	// Another replica drained the next key: the pick is undone and the
+	// request goes to the other key
+	next := lb.apiKeys[1]
+	if stats[1].AvailableTokens < stats[0].AvailableTokens {
+		next = lb.apiKeys[0]
+	}
+	server.HSet("test:ratelimit:"+hashKey(next.Key), "tokens", "0", "ts", strconv.FormatInt(time.Now().UnixMilli(), 10))
+	key, err := lb.GetNextKey()
+	if err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+	if key == next || next.RequestCount.Load() != 0 || next.inFlight.Load() != 0 {
+		t.Errorf("Expected the drained key to be skipped and its pick undone")
+	}
+	if next.RateLimiter.AvailableTokens() != 0 {
+		t.Errorf("Expected the drained bucket to be seen as empty, got %d", next.RateLimiter.AvailableTokens())
+	}
+}
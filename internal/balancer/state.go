@@ -0,0 +1,141 @@
+package balancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// KeyState is the part of an API key's state worth keeping across restarts.
+// Keys are identified by a hash so the raw key is never written out.
+type KeyState struct {
+	KeyHash string `json:"key_hash"`
+
+	RequestCount     uint64    `json:"request_count"`
+	ErrorCount       uint64    `json:"error_count"`
+	PromptTokens     uint64    `json:"prompt_tokens"`
+	CompletionTokens uint64    `json:"completion_tokens"`
+	LastUsed         time.Time `json:"last_used"`
+
+	// Requests per minute limiter: the requests available as of LastRefill
+	Tokens      int       `json:"tokens"`
+	LastRefill  time.Time `json:"last_refill"`
+	PausedUntil time.Time `json:"paused_until"`
+
+	// Tokens per minute budget
+	TokenBudget       float64   `json:"token_budget"`
+	TokenBudgetRefill time.Time `json:"token_budget_refill"`
+
+	Quota QuotaState `json:"quota"`
+
+	Disabled       bool      `json:"disabled"`
+	DisabledReason string    `json:"disabled_reason,omitempty"`
+	DisabledAt     time.Time `json:"disabled_at"`
+}
+
+// QuotaState is what a key used in its current quota windows
+type QuotaState struct {
+	Day           string `json:"day"`
+	Month         string `json:"month"`
+	DayRequests   int64  `json:"day_requests"`
+	DayTokens     int64  `json:"day_tokens"`
+	MonthRequests int64  `json:"month_requests"`
+	MonthTokens   int64  `json:"month_tokens"`
+}
+
+// keyIDLength is how many hex digits of the key hash identify a key in stats
+const keyIDLength = 8
+
+// hashKey identifies an API key in saved state without revealing it
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Snapshot returns the state of the configured keys
+func (lb *LoadBalancer) Snapshot() []KeyState {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	states := make([]KeyState, len(lb.apiKeys))
+	for i, key := range lb.apiKeys {
+		states[i] = key.state()
+	}
+	return states
+}
+
+// state captures the key's counters, limiters, quota and quarantine
+func (k *APIKey) state() KeyState {
+	s := KeyState{
+		KeyHash:          hashKey(k.Key),
+		RequestCount:     k.RequestCount.Load(),
+		ErrorCount:       k.ErrorCount.Load(),
+		PromptTokens:     k.PromptTokens.Load(),
+		CompletionTokens: k.CompletionTokens.Load(),
+		LastUsed:         k.LastUsed,
+		Quota:            k.Quota.state(),
+	}
+
+	s.Tokens, s.LastRefill, s.PausedUntil = k.RateLimiter.snapshot()
+
+	k.TokenLimiter.mu.Lock()
+	s.TokenBudget, s.TokenBudgetRefill = k.TokenLimiter.available, k.TokenLimiter.lastRefill
+	k.TokenLimiter.mu.Unlock()
+
+	k.mu.Lock()
+	s.Disabled, s.DisabledReason, s.DisabledAt = k.disabled, k.disabledReason, k.disabledAt
+	k.mu.Unlock()
+
+	return s
+}
+
+// restore puts back saved state. Limiter buckets are clamped to the current
+// limits, and refill from the saved time so downtime still counts.
+func (k *APIKey) restore(s KeyState) {
+	k.RequestCount.Store(s.RequestCount)
+	k.ErrorCount.Store(s.ErrorCount)
+	k.PromptTokens.Store(s.PromptTokens)
+	k.CompletionTokens.Store(s.CompletionTokens)
+	k.LastUsed = s.LastUsed
+	k.Quota.restore(s.Quota)
+
+	k.RateLimiter.restore(s.Tokens, s.LastRefill, s.PausedUntil)
+
+	tl := k.TokenLimiter
+	tl.mu.Lock()
+	if tl.limit > 0 && !s.TokenBudgetRefill.IsZero() {
+		tl.available = min(s.TokenBudget, float64(tl.limit))
+		tl.lastRefill = s.TokenBudgetRefill
+	}
+	tl.mu.Unlock()
+
+	k.mu.Lock()
+	k.disabled, k.disabledReason, k.disabledAt = s.Disabled, s.DisabledReason, s.DisabledAt
+	k.mu.Unlock()
+}
+
+// state returns the usage in the current windows
+func (q *Quota) state() QuotaState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return QuotaState{
+		Day:           q.day,
+		Month:         q.month,
+		DayRequests:   q.dayRequests,
+		DayTokens:     q.dayTokens,
+		MonthRequests: q.monthRequests,
+		MonthTokens:   q.monthTokens,
+	}
+}
+
+// restore puts back saved usage. Windows that have since ended are reset the
+// next time the quota is used.
+func (q *Quota) restore(s QuotaState) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.day, q.month = s.Day, s.Month
+	q.dayRequests, q.dayTokens = s.DayRequests, s.DayTokens
+	q.monthRequests, q.monthTokens = s.MonthRequests, s.MonthTokens
+}
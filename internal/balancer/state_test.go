@@ -0,0 +1,61 @@
+package balancer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+func TestLoadBalancer_SnapshotRestore(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		APIKeys:   []string{"nvapi-key-0001", "nvapi-key-0002"},
+		RateLimit: 10,
+		Quota:     config.QuotaConfig{RequestsPerDay: 100},
+	}
+	lb := NewLoadBalancer(cfg)
+
+	for i := 0; i < 4; i++ {
+		key, _ := lb.GetNextKey()
+		lb.RecordUsage(key, 10, 5)
+	}
+	key, _ := lb.GetNextKey()
+	lb.MarkKeyError(key)
+	lb.DisableKey(lb.apiKeys[1], "upstream returned 401")
+
+	saved := lb.Snapshot()
+	data, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatalf("Failed to encode snapshot: %v", err)
+	}
+	if strings.Contains(string(data), "nvapi-key") {
+		t.Error("Snapshot must not contain the raw API keys")
+	}
+
+	// A key missing from the new configuration is ignored, a new one starts fresh
+	restored := NewLoadBalancer(&config.NVIDIAConfig{
+		APIKeys:   []string{"nvapi-key-0001", "nvapi-key-0003"},
+		RateLimit: 10,
+		Quota:     config.QuotaConfig{RequestsPerDay: 100},
+	}, saved...)
+
+	stats := restored.GetStats()
+	if stats[0].RequestCount != 3 || stats[0].ErrorCount != 1 || stats[0].PromptTokens != 20 {
+		t.Errorf("Expected counters to be restored, got %+v", stats[0])
+	}
+	if stats[0].AvailableTokens != 7 {
+		t.Errorf("Expected the rate limiter to stay drained after a restart, got %d tokens", stats[0].AvailableTokens)
+	}
+	if stats[0].Quota.RequestsLeftToday != 97 {
+		t.Errorf("Expected the quota to be restored, got %d requests left", stats[0].Quota.RequestsLeftToday)
+	}
+	if stats[1].RequestCount != 0 || stats[1].AvailableTokens != 10 {
+		t.Errorf("Expected a new key to start fresh, got %+v", stats[1])
+	}
+
+	disabled := NewLoadBalancer(cfg, saved...).GetDisabledKeys()
+	if len(disabled) != 1 || disabled[0].Index != 1 {
+		t.Errorf("Expected the quarantined key to stay disabled, got %+v", disabled)
+	}
+}
@@ -0,0 +1,189 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// candidates returns the indexes of the keys in the order the upstream's
+// strategy wants them tried, or in the affinity's order when one is given.
+// Must be called with the read lock and queueMu held.
+func (lb *LoadBalancer) candidates(affinity string) []int {
+	total := len(lb.apiKeys)
+	if affinity != "" {
+		return lb.affinityOrder(affinity)
+	}
+
+	// Every strategy starts from the round-robin rotation so ties are spread
+	// over the keys rather than always going to the first one
+	start := int(lb.currentIndex.Load())
+	order := make([]int, total)
+	for i := range order {
+		order[i] = (start + i) % total
+	}
+
+	keys := lb.apiKeys
+	switch lb.config.Strategy {
+	case config.StrategyWeightedRoundRobin:
+		sort.SliceStable(order, func(a, b int) bool {
+			ka, kb := keys[order[a]], keys[order[b]]
+			return ka.currentWeight+ka.Weight > kb.currentWeight+kb.Weight
+		})
+	case config.StrategyLeastRecentlyUsed:
+		sort.SliceStable(order, func(a, b int) bool {
+			return keys[order[a]].LastUsed.Before(keys[order[b]].LastUsed)
+		})
+	case config.StrategyMostTokensRemaining:
+		available := make([]int, total)
+		for i, key := range keys {
+			available[i] = key.RateLimiter.AvailableTokens()
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return available[order[a]] > available[order[b]]
+		})
+	case config.StrategyTiered:
+		sort.SliceStable(order, func(a, b int) bool {
+			return keys[order[a]].Tier < keys[order[b]].Tier
+		})
+	case config.StrategyLeastLatency:
+		scores := healthScores(keys)
+		sort.SliceStable(order, func(a, b int) bool {
+			return scores[order[a]] < scores[order[b]]
+		})
+	case config.StrategyPowerOfTwoChoices:
+		powerOfTwoChoices(order, healthScores(keys))
+	}
+
+	return order
+}
+
+// picked advances the strategy's state after the key at index was handed
+// out. Must be called with the read lock and queueMu held.
+func (lb *LoadBalancer) picked(index int) {
+	lb.currentIndex.Store(uint32((index + 1) % len(lb.apiKeys)))
+
+	if lb.config.Strategy != config.StrategyWeightedRoundRobin {
+		return
+	}
+
+	// Smooth weighted round-robin: every key gains its weight and the picked
+	// key pays back the total, so picks are interleaved in weight proportion
+	total := 0
+	for _, key := range lb.apiKeys {
+		key.currentWeight += key.Weight
+		total += key.Weight
+	}
+	lb.apiKeys[index].currentWeight -= total
+}
+
+// healthScores returns the health score of every key. Keys not measured yet
+// are assumed to be as fast as the median measured key, so they are neither
+// favoured nor avoided until measured.
+func healthScores(keys []*APIKey) []float64 {
+	var measured []time.Duration
+	for _, key := range keys {
+		if ttfb := key.Health.TTFB(); ttfb > 0 {
+			measured = append(measured, ttfb)
+		}
+	}
+
+	prior := defaultTTFB
+	if len(measured) > 0 {
+		slices.Sort(measured)
+		prior = measured[len(measured)/2]
+	}
+
+	scores := make([]float64, len(keys))
+	for i, key := range keys {
+		scores[i] = key.Health.Score(prior)
+	}
+	return scores
+}
+
+// powerOfTwoChoices moves two keys drawn at random to the front of the order,
+// the healthier one first. Load is spread like random selection while keys
+// that are clearly worse than most others are rarely picked. The rest of the
+// order stays as a fallback when both are unavailable.
+func powerOfTwoChoices(order []int, scores []float64) {
+	if len(order) < 2 {
+		return
+	}
+
+	i := rand.Intn(len(order))
+	j := rand.Intn(len(order) - 1)
+	if j >= i {
+		j++
+	}
+	if scores[order[j]] < scores[order[i]] {
+		i, j = j, i
+	}
+
+	first, second := order[i], order[j]
+	rest := make([]int, 0, len(order)-2)
+	for k, index := range order {
+		if k != i && k != j {
+			rest = append(rest, index)
+		}
+	}
+	order[0], order[1] = first, second
+	copy(order[2:], rest)
+}
+
+// affinityOrder ranks the keys by rendezvous hashing of the affinity, so the
+// same affinity always prefers the same key, on every replica. Adding or
+// removing a key only moves the affinities that preferred that key. The
+// strategy's preference still comes first: tiered keeps affinities within
+// the lowest tier, and weighted round-robin hands them out by weight.
+func (lb *LoadBalancer) affinityOrder(affinity string) []int {
+	keys, strategy := lb.apiKeys, lb.config.Strategy
+	scores := make([]float64, len(keys))
+	order := make([]int, len(keys))
+	for i, key := range keys {
+		weight := 1
+		if strategy == config.StrategyWeightedRoundRobin {
+			weight = key.Weight
+		}
+		scores[i] = affinityScore(affinity, key.Key, weight)
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		ka, kb := keys[order[a]], keys[order[b]]
+		if strategy == config.StrategyTiered && ka.Tier != kb.Tier {
+			return ka.Tier < kb.Tier
+		}
+		return scores[order[a]] > scores[order[b]]
+	})
+	return order
+}
+
+// affinityScore is the weighted rendezvous score of a key for an affinity.
+// Keys have the highest score for a share of the affinities in proportion
+// to their weight.
+func affinityScore(affinity, key string, weight int) float64 {
+	// A uniform draw in (0, 1) from the top 53 bits of the hash
+	u := (float64(affinityHash(affinity, key)>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
+
+// affinityHash hashes an affinity together with a key
+func affinityHash(affinity, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(affinity))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+
+	// FNV mixes the last bytes poorly, so finish with the splitmix64 finalizer
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,315 @@
+package balancer
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// pickKeys returns the keys handed out by n calls to GetNextKey
+func pickKeys(t *testing.T, lb *LoadBalancer, n int) []string {
+	t.Helper()
+
+	keys := make([]string, n)
+	for i := range keys {
+		key, err := lb.GetNextKey()
+		if err != nil {
+			t.Fatalf("Failed to get key %d: %v", i, err)
+		}
+		keys[i] = key.Key
+	}
+	return keys
+}
+
+func TestLoadBalancer_WeightedRoundRobin(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		Keys:      []config.KeyConfig{{Key: "paid", Weight: 3}, {Key: "trial", Weight: 1}},
+		Strategy:  config.StrategyWeightedRoundRobin,
+	}
+	lb := NewLoadBalancer(cfg)
+
+	counts := make(map[string]int)
+	for _, key := range pickKeys(t, lb, 8) {
+		counts[key]++
+	}
+	if counts["paid"] != 6 || counts["trial"] != 2 {
+		t.Errorf("Expected 6 paid and 2 trial picks, got %v", counts)
+	}
+}
+
+func TestLoadBalancer_Tiered(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		Keys: []config.KeyConfig{
+			{Key: "trial", Tier: 2},
+			{Key: "paid1", Tier: 1, RateLimit: 2},
+			{Key: "paid2", Tier: 1, RateLimit: 2},
+		},
+		Strategy: config.StrategyTiered,
+	}
+	lb := NewLoadBalancer(cfg)
+
+	// Tier 1 keys are used until their rate limits run out
+	keys := pickKeys(t, lb, 5)
+	for i, key := range keys[:4] {
+		if key == "trial" {
+			t.Fatalf("Expected tier 1 key for pick %d, got trial (%v)", i, keys)
+		}
+	}
+	if keys[4] != "trial" {
+		t.Errorf("Expected overflow to trial, got %s", keys[4])
+	}
+}
+
+func TestLoadBalancer_LeastRecentlyUsed(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		APIKeys:   []string{"key1", "key2", "key3"},
+		Strategy:  config.StrategyLeastRecentlyUsed,
+	}
+	lb := NewLoadBalancer(cfg)
+
+	now := time.Now()
+	lb.apiKeys[0].LastUsed = now.Add(-time.Minute)
+	lb.apiKeys[1].LastUsed = now.Add(-time.Hour)
+	lb.apiKeys[2].LastUsed = now.Add(-time.Second)
+
+	keys := pickKeys(t, lb, 3)
+	if keys[0] != "key2" || keys[1] != "key1" || keys[2] != "key3" {
+		t.Errorf("Expected key2, key1, key3, got %v", keys)
+	}
+}
+
+func TestLoadBalancer_MostTokensRemaining(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		Keys:      []config.KeyConfig{{Key: "small", RateLimit: 2}, {Key: "large", RateLimit: 4}},
+		Strategy:  config.StrategyMostTokensRemaining,
+	}
+	lb := NewLoadBalancer(cfg)
+
+	// large has 4 left against 2, so it serves until both have 2 left
+	keys := pickKeys(t, lb, 2)
+	if keys[0] != "large" || keys[1] != "large" {
+		t.Errorf("Expected large twice, got %v", keys)
+	}
+}
+
+func TestLoadBalancer_PerKeyRateLimit(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		Keys:      []config.KeyConfig{{Key: "key1", RateLimit: 1}},
+	}
+	lb := NewLoadBalancer(cfg)
+
+	pickKeys(t, lb, 1)
+	if _, err := lb.GetNextKey(); !errors.Is(err, ErrKeysExhausted) {
+		t.Errorf("Expected ErrKeysExhausted after the key's own limit, got %v", err)
+	}
+
+	// A reload applies a new per-key limit
+	lb.Reload(&config.NVIDIAConfig{
+		RateLimit: 100,
+		Keys:      []config.KeyConfig{{Key: "key1", RateLimit: 5, Weight: 2, Tier: 3}},
+	})
+	stats := lb.GetStats()
+	if stats[0].Weight != 2 || stats[0].Tier != 3 {
+		t.Errorf("Expected weight 2 and tier 3, got %d and %d", stats[0].Weight, stats[0].Tier)
+	}
+}
+
+func TestLoadBalancer_LeastLatency(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		APIKeys:   []string{"slow", "fast", "flaky"},
+		Strategy:  config.StrategyLeastLatency,
+	}
+	lb := NewLoadBalancer(cfg)
+
+	lb.ObserveTTFB(lb.apiKeys[0], 2*time.Second)
+	lb.ObserveTTFB(lb.apiKeys[1], 200*time.Millisecond)
+	lb.ObserveTTFB(lb.apiKeys[2], 100*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		lb.MarkKeyError(lb.apiKeys[2])
+	}
+
+	for i, key := range pickKeys(t, lb, 3) {
+		if key != "fast" {
+			t.Errorf("Expected fast for pick %d, got %s", i, key)
+		}
+	}
+
+	stats := lb.GetStats()
+	if stats[1].AvgTTFBMs != 200 || stats[2].ErrorRate == 0 {
+		t.Errorf("Expected health in stats, got %+v and %+v", stats[1], stats[2])
+	}
+}
+
+func TestLoadBalancer_LeastLatencyTransportErrors(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		APIKeys:   []string{"unreachable", "healthy", "unmeasured"},
+		Strategy:  config.StrategyLeastLatency,
+	}
+	lb := NewLoadBalancer(cfg)
+
+	// Requests on the first key fail before any response, so it never gets a
+	// time to first byte but must not look like the fastest key
+	for i := 0; i < 5; i++ {
+		lb.MarkKeyError(lb.apiKeys[0])
+	}
+	lb.ObserveTTFB(lb.apiKeys[1], 500*time.Millisecond)
+	lb.MarkKeySuccess(lb.apiKeys[1])
+
+	for i, key := range pickKeys(t, lb, 3) {
+		if key == "unreachable" {
+			t.Errorf("Expected the unreachable key to be avoided, got it for pick %d", i)
+		}
+	}
+
+	stats := lb.GetStats()
+	if stats[0].HealthScore <= stats[1].HealthScore {
+		t.Errorf("Expected the unreachable key to score worse, got %f and %f", stats[0].HealthScore, stats[1].HealthScore)
+	}
+	if stats[2].HealthScore != stats[1].HealthScore {
+		t.Errorf("Expected the unmeasured key to score like the median key, got %f", stats[2].HealthScore)
+	}
+}
+
+func TestLoadBalancer_PowerOfTwoChoices(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 1000,
+		APIKeys:   []string{"slow", "fast1", "fast2"},
+		Strategy:  config.StrategyPowerOfTwoChoices,
+	}
+	lb := NewLoadBalancer(cfg)
+
+	lb.ObserveTTFB(lb.apiKeys[0], 2*time.Second)
+	lb.ObserveTTFB(lb.apiKeys[1], 100*time.Millisecond)
+	lb.ObserveTTFB(lb.apiKeys[2], 100*time.Millisecond)
+
+	// The slow key loses every draw, while the equally fast keys share the load
+	counts := make(map[string]int)
+	for _, key := range pickKeys(t, lb, 300) {
+		counts[key]++
+	}
+	if counts["slow"] != 0 {
+		t.Errorf("Expected the slow key never to be picked, got %d", counts["slow"])
+	}
+	if counts["fast1"] < 50 || counts["fast2"] < 50 {
+		t.Errorf("Expected load spread over the fast keys, got %v", counts)
+	}
+}
+
+func TestLoadBalancer_Affinity(t *testing.T) {
+	cfg := &config.NVIDIAConfig{
+		RateLimit: 100,
+		APIKeys:   []string{"key1", "key2", "key3", "key4"},
+	}
+	lb := NewLoadBalancer(cfg)
+
+	acquire := func(affinity string) string {
+		lb.queueMu.Lock()
+		defer lb.queueMu.Unlock()
+
+		p, err := lb.selectKey(AcquireOptions{Affinity: affinity})
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+		return p.key.Key
+	}
+
+	preferred := acquire("session-1")
+	for i := 0; i < 5; i++ {
+		if key := acquire("session-1"); key != preferred {
+			t.Fatalf("Expected session to stick to %s, got %s", preferred, key)
+		}
+	}
+
+	// Different affinities are spread over the keys
+	used := make(map[string]bool)
+	for i := 0; i < 40; i++ {
+		used[acquire("session-"+strconv.Itoa(i))] = true
+	}
+	if len(used) < 3 {
+		t.Errorf("Expected affinities spread over the keys, got %v", used)
+	}
+
+	// Another key takes over only while the preferred one is unavailable
+	for _, key := range lb.apiKeys {
+		if key.Key == preferred {
+			lb.DisableKey(key, "test")
+		}
+	}
+	if key := acquire("session-1"); key == preferred {
+		t.Errorf("Expected fallback away from the disabled key")
+	}
+	if err := lb.EnableKey(slices.IndexFunc(lb.apiKeys, func(k *APIKey) bool { return k.Key == preferred })); err != nil {
+		t.Fatal(err)
+	}
+	if key := acquire("session-1"); key != preferred {
+		t.Errorf("Expected session back on %s, got %s", preferred, key)
+	}
+}
+
+func TestLoadBalancer_AffinityWithinStrategy(t *testing.T) {
+	acquire := func(lb *LoadBalancer, affinity string) string {
+		lb.queueMu.Lock()
+		defer lb.queueMu.Unlock()
+
+		p, err := lb.selectKey(AcquireOptions{Affinity: affinity})
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+		return p.key.Key
+	}
+
+	// Tiered keeps every affinity on tier 1 while it has a key available
+	tiered := NewLoadBalancer(&config.NVIDIAConfig{
+		RateLimit: 1000,
+		Strategy:  config.StrategyTiered,
+		Keys: []config.KeyConfig{
+			{Key: "trial1", Tier: 2},
+			{Key: "paid1", Tier: 1},
+			{Key: "trial2", Tier: 2},
+			{Key: "paid2", Tier: 1},
+		},
+	})
+	used := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		used[acquire(tiered, "session-"+strconv.Itoa(i))]++
+	}
+	if used["paid1"] == 0 || used["paid2"] == 0 || used["paid1"]+used["paid2"] != 40 {
+		t.Errorf("Expected affinities spread over the tier 1 keys only, got %v", used)
+	}
+	tiered.DisableKey(tiered.apiKeys[1], "test")
+	tiered.DisableKey(tiered.apiKeys[3], "test")
+	if key := acquire(tiered, "session-1"); !strings.HasPrefix(key, "trial") {
+		t.Errorf("Expected tier 2 once tier 1 is unavailable, got %s", key)
+	}
+
+	// Weighted round-robin hands out affinities by weight
+	weighted := NewLoadBalancer(&config.NVIDIAConfig{
+		RateLimit: 10000,
+		Strategy:  config.StrategyWeightedRoundRobin,
+		Keys: []config.KeyConfig{
+			{Key: "heavy", Weight: 9},
+			{Key: "light", Weight: 1},
+		},
+	})
+	heavy := 0
+	for i := 0; i < 1000; i++ {
+		if acquire(weighted, "session-"+strconv.Itoa(i)) == "heavy" {
+			heavy++
+		}
+	}
+	if heavy < 850 || heavy > 950 {
+		t.Errorf("Expected about 900 of 1000 affinities on the heavy key, got %d", heavy)
+	}
+}
@@ -0,0 +1,139 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenLimiter limits the prompt and completion tokens an API key may use per
+// minute. Requests reserve an estimate before they are sent, which is settled
+// against the usage upstream reports once they finish.
+type TokenLimiter struct {
+	available  float64
+	limit      int // tokens per minute, 0 means unlimited
+	lastRefill time.Time
+	mu         sync.Mutex
+}
+
+// NewTokenLimiter creates a token limiter. A limit of 0 never limits.
+func NewTokenLimiter(tokensPerMinute int) *TokenLimiter {
+	return &TokenLimiter{
+		available:  float64(tokensPerMinute),
+		limit:      tokensPerMinute,
+		lastRefill: time.Now(),
+	}
+}
+
+// TryReserve takes the estimated tokens for a request, returns true if
+// successful. A request larger than the whole budget is let through once the
+// budget is full, so it is slowed down rather than refused forever.
+func (tl *TokenLimiter) TryReserve(tokens int) bool {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.limit == 0 {
+		return true
+	}
+
+	tl.refill()
+
+	if tl.available < float64(tl.needed(tokens)) {
+		return false
+	}
+	tl.available -= float64(tokens)
+	return true
+}
+
+// Settle replaces a reservation with the tokens actually used, giving back
+// what was overestimated or charging what was underestimated
+func (tl *TokenLimiter) Settle(reserved, used int) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.limit == 0 {
+		return
+	}
+
+	tl.refill()
+
+	tl.available += float64(reserved - used)
+	if tl.available > float64(tl.limit) {
+		tl.available = float64(tl.limit)
+	}
+}
+
+// SetLimit changes the tokens per minute, keeping the tokens already in the
+// budget up to the new maximum
+func (tl *TokenLimiter) SetLimit(tokensPerMinute int) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.limit == 0 {
+		tl.available = float64(tokensPerMinute)
+	} else {
+		tl.refill()
+	}
+	tl.limit = tokensPerMinute
+	if tl.available > float64(tl.limit) {
+		tl.available = float64(tl.limit)
+	}
+}
+
+// needed returns how much must be available to reserve the given tokens. Must
+// be called with the lock held.
+func (tl *TokenLimiter) needed(tokens int) int {
+	if tokens > tl.limit {
+		tokens = tl.limit
+	}
+	if tokens < 1 {
+		tokens = 1
+	}
+	return tokens
+}
+
+// refill adds tokens based on elapsed time. Must be called with the lock held.
+func (tl *TokenLimiter) refill() {
+	now := time.Now()
+	elapsed := now.Sub(tl.lastRefill)
+	tl.lastRefill = now
+
+	tl.available += elapsed.Minutes() * float64(tl.limit)
+	if tl.available > float64(tl.limit) {
+		tl.available = float64(tl.limit)
+	}
+}
+
+// AvailableTokens returns the tokens that can currently be reserved, or -1
+// when there is no limit
+func (tl *TokenLimiter) AvailableTokens() int {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.limit == 0 {
+		return -1
+	}
+
+	tl.refill()
+	if tl.available < 0 {
+		return 0
+	}
+	return int(tl.available)
+}
+
+// TimeUntilAvailable returns the duration until the given tokens can be reserved
+func (tl *TokenLimiter) TimeUntilAvailable(tokens int) time.Duration {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.limit == 0 {
+		return 0
+	}
+
+	tl.refill()
+
+	missing := float64(tl.needed(tokens)) - tl.available
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / float64(tl.limit) * float64(time.Minute))
+}
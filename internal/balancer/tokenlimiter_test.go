@@ -0,0 +1,85 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenLimiter_TryReserve(t *testing.T) {
+	tl := NewTokenLimiter(1000)
+
+	if !tl.TryReserve(600) {
+		t.Fatal("Failed to reserve tokens within the budget")
+	}
+	if tl.TryReserve(600) {
+		t.Error("Should not be able to reserve beyond the budget")
+	}
+	if !tl.TryReserve(400) {
+		t.Error("Failed to reserve the rest of the budget")
+	}
+	if tl.TryReserve(0) {
+		t.Error("Should not hand out requests once the budget is spent")
+	}
+}
+
+func TestTokenLimiter_Settle(t *testing.T) {
+	tl := NewTokenLimiter(1000)
+
+	tl.TryReserve(800)
+	tl.Settle(800, 100)
+	if tokens := tl.AvailableTokens(); tokens != 900 {
+		t.Errorf("Expected overestimate to be given back, got %d", tokens)
+	}
+
+	tl.TryReserve(100)
+	tl.Settle(100, 900)
+	if tokens := tl.AvailableTokens(); tokens != 0 {
+		t.Errorf("Expected underestimate to be charged, got %d", tokens)
+	}
+	if tl.TryReserve(1) {
+		t.Error("Should not reserve while in debt")
+	}
+}
+
+func TestTokenLimiter_OversizedRequest(t *testing.T) {
+	tl := NewTokenLimiter(1000)
+
+	// A request larger than the budget goes through once the budget is full
+	if !tl.TryReserve(5000) {
+		t.Fatal("Expected an oversized request to go through with a full budget")
+	}
+	if tl.TryReserve(1) {
+		t.Error("Expected the oversized request to use up the budget")
+	}
+
+	// Paying off the debt takes longer than a single minute
+	if wait := tl.TimeUntilAvailable(1); wait < 4*time.Minute {
+		t.Errorf("Expected to wait for the debt to be repaid, got %s", wait)
+	}
+}
+
+func TestTokenLimiter_Refill(t *testing.T) {
+	tl := NewTokenLimiter(1000)
+	tl.TryReserve(1000)
+
+	// Manually set lastRefill to half a minute ago
+	tl.lastRefill = time.Now().Add(-30 * time.Second)
+
+	if tokens := tl.AvailableTokens(); tokens < 500 || tokens > 501 {
+		t.Errorf("Expected about 500 tokens after half a minute, got %d", tokens)
+	}
+}
+
+func TestTokenLimiter_Unlimited(t *testing.T) {
+	tl := NewTokenLimiter(0)
+
+	if !tl.TryReserve(1_000_000) {
+		t.Error("Expected no limit without tokens per minute")
+	}
+	if tokens := tl.AvailableTokens(); tokens != -1 {
+		t.Errorf("Expected -1 available tokens without a limit, got %d", tokens)
+	}
+	if wait := tl.TimeUntilAvailable(1_000_000); wait != 0 {
+		t.Errorf("Expected no wait without a limit, got %s", wait)
+	}
+}
@@ -0,0 +1,245 @@
+package clients
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+var (
+	// ErrInvalidKey is returned for a missing or unknown virtual key
+	ErrInvalidKey = errors.New("invalid API key")
+	// ErrExpiredKey is returned for a virtual key past its expiry
+	ErrExpiredKey = errors.New("API key has expired")
+	// ErrRateLimited is returned when a client exceeds its requests per minute
+	ErrRateLimited = errors.New("client request rate limit exceeded")
+	// ErrTokenBudgetExceeded is returned when a client used up its daily tokens
+	ErrTokenBudgetExceeded = errors.New("client daily token budget exceeded")
+)
+
+// Client is a consumer of the proxy identified by a virtual API key
+type Client struct {
+	Name string
+
+	config   atomic.Pointer[config.ClientConfig]
+	limiter  atomic.Pointer[balancer.RateLimiter] // nil when requests are unlimited
+	requests atomic.Uint64
+	rejected atomic.Uint64
+
+	// Daily token budget, reset at midnight UTC
+	day              string
+	tokensToday      int64
+	promptTokens     int64
+	completionTokens int64
+	mu               sync.Mutex
+}
+
+// Registry holds the configured clients indexed by their virtual key
+type Registry struct {
+	clients []*Client
+	byKey   map[string]*Client
+}
+
+// NewRegistry creates a registry from the configured clients
+func NewRegistry(cfgs []config.ClientConfig) *Registry {
+	r := &Registry{
+		clients: make([]*Client, len(cfgs)),
+		byKey:   make(map[string]*Client, len(cfgs)),
+	}
+
+	for i, cfg := range cfgs {
+		client := &Client{Name: cfg.Name}
+		client.configure(cfg)
+
+		r.clients[i] = client
+		r.byKey[cfg.Key] = client
+	}
+
+	return r
+}
+
+// Reload returns a registry for new client settings. Clients are carried
+// over by key with their usage counters and rate limiter, and get the new
+// settings.
+func (r *Registry) Reload(cfgs []config.ClientConfig) *Registry {
+	next := NewRegistry(cfgs)
+	for i, cfg := range cfgs {
+		prev, ok := r.byKey[cfg.Key]
+		switch {
+		case !ok:
+		case prev.Name == cfg.Name:
+			prev.configure(cfg)
+			next.clients[i] = prev
+			next.byKey[cfg.Key] = prev
+		default:
+			next.clients[i].takeOver(prev)
+		}
+	}
+	return next
+}
+
+// configure applies client settings, keeping the requests left in the
+// client's rate limiter
+func (c *Client) configure(cfg config.ClientConfig) {
+	c.config.Store(&cfg)
+
+	rl := c.limiter.Load()
+	switch {
+	case cfg.RequestsPerMinute == 0:
+		c.limiter.Store(nil)
+	case rl == nil:
+		c.limiter.Store(balancer.NewRateLimiter(cfg.RequestsPerMinute))
+	default:
+		rl.SetLimit(cfg.RequestsPerMinute)
+	}
+}
+
+// takeOver carries the usage and rate limiter of a renamed client over to c,
+// which has just been created
+func (c *Client) takeOver(prev *Client) {
+	c.requests.Store(prev.requests.Load())
+	c.rejected.Store(prev.rejected.Load())
+	if rl := prev.limiter.Load(); rl != nil && c.limiter.Load() != nil {
+		rl.SetLimit(c.config.Load().RequestsPerMinute)
+		c.limiter.Store(rl)
+	}
+
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	c.day, c.tokensToday = prev.day, prev.tokensToday
+	c.promptTokens, c.completionTokens = prev.promptTokens, prev.completionTokens
+}
+
+// Enabled reports whether virtual keys are required. With no clients
+// configured the proxy stays open, as before.
+func (r *Registry) Enabled() bool {
+	return len(r.clients) > 0
+}
+
+// Authenticate looks up the client owning a virtual key
+func (r *Registry) Authenticate(key string) (*Client, error) {
+	client, ok := r.byKey[key]
+	if !ok || key == "" {
+		return nil, ErrInvalidKey
+	}
+
+	if expiresAt := client.config.Load().ExpiresAt; !expiresAt.IsZero() && time.Now().After(expiresAt) {
+		client.rejected.Add(1)
+		return nil, ErrExpiredKey
+	}
+
+	return client, nil
+}
+
+// AllowsModel reports whether the client may use the given model
+func (c *Client) AllowsModel(model string) bool {
+	allowedModels := c.config.Load().AllowedModels
+	if len(allowedModels) == 0 {
+		return true
+	}
+
+	for _, allowed := range allowedModels {
+		if allowed == model {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow checks the client's budgets and counts the request against them
+func (c *Client) Allow() error {
+	if limit := c.config.Load().TokensPerDay; limit > 0 {
+		c.mu.Lock()
+		c.rollDay(time.Now())
+		exhausted := c.tokensToday >= int64(limit)
+		c.mu.Unlock()
+
+		if exhausted {
+			c.rejected.Add(1)
+			return ErrTokenBudgetExceeded
+		}
+	}
+
+	if rl := c.limiter.Load(); rl != nil && !rl.TryAcquire() {
+		c.rejected.Add(1)
+		return ErrRateLimited
+	}
+
+	c.requests.Add(1)
+	return nil
+}
+
+// Reject counts a request turned away for a reason other than its budgets
+func (c *Client) Reject() {
+	c.rejected.Add(1)
+}
+
+// RecordUsage adds tokens consumed by the client to its totals and its
+// daily budget
+func (c *Client) RecordUsage(promptTokens, completionTokens int) {
+	if promptTokens <= 0 && completionTokens <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rollDay(time.Now())
+	c.tokensToday += int64(promptTokens + completionTokens)
+	c.promptTokens += int64(promptTokens)
+	c.completionTokens += int64(completionTokens)
+}
+
+// rollDay resets the daily token count when the UTC day changes. Must be
+// called with the lock held.
+func (c *Client) rollDay(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	if day != c.day {
+		c.day = day
+		c.tokensToday = 0
+	}
+}
+
+// GetStats returns usage statistics for all clients
+func (r *Registry) GetStats() []ClientStats {
+	stats := make([]ClientStats, len(r.clients))
+	for i, client := range r.clients {
+		client.mu.Lock()
+		client.rollDay(time.Now())
+		tokensToday := client.tokensToday
+		prompt, completion := client.promptTokens, client.completionTokens
+		client.mu.Unlock()
+
+		cfg := client.config.Load()
+		stats[i] = ClientStats{
+			Name:             client.Name,
+			RequestCount:     client.requests.Load(),
+			Rejected:         client.rejected.Load(),
+			TokensToday:      tokensToday,
+			TokensPerDay:     cfg.TokensPerDay,
+			PromptTokens:     prompt,
+			CompletionTokens: completion,
+			TotalTokens:      prompt + completion,
+			ExpiresAt:        cfg.ExpiresAt,
+		}
+	}
+
+	return stats
+}
+
+// ClientStats represents usage statistics for a client
+type ClientStats struct {
+	Name             string
+	RequestCount     uint64
+	Rejected         uint64
+	TokensToday      int64
+	TokensPerDay     int
+	PromptTokens     int64
+	CompletionTokens int64
+	TotalTokens      int64
+	ExpiresAt        time.Time
+}
@@ -0,0 +1,152 @@
+package clients
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+func TestRegistry_Authenticate(t *testing.T) {
+	r := NewRegistry([]config.ClientConfig{
+		{Name: "web", Key: "sk-web"},
+		{Name: "old", Key: "sk-old", ExpiresAt: time.Now().Add(-time.Hour)},
+	})
+
+	if !r.Enabled() {
+		t.Fatal("Expected registry with clients to be enabled")
+	}
+
+	client, err := r.Authenticate("sk-web")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+	if client.Name != "web" {
+		t.Errorf("Expected client web, got %s", client.Name)
+	}
+
+	if _, err := r.Authenticate("sk-unknown"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+	if _, err := r.Authenticate(""); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey for empty key, got %v", err)
+	}
+	if _, err := r.Authenticate("sk-old"); !errors.Is(err, ErrExpiredKey) {
+		t.Errorf("Expected ErrExpiredKey, got %v", err)
+	}
+}
+
+func TestRegistry_Disabled(t *testing.T) {
+	if NewRegistry(nil).Enabled() {
+		t.Error("Expected registry without clients to be disabled")
+	}
+}
+
+func TestClient_AllowsModel(t *testing.T) {
+	r := NewRegistry([]config.ClientConfig{
+		{Name: "any", Key: "sk-any"},
+		{Name: "limited", Key: "sk-limited", AllowedModels: []string{"minimaxai/minimax-m2"}},
+	})
+
+	anyClient, _ := r.Authenticate("sk-any")
+	if !anyClient.AllowsModel("whatever") {
+		t.Error("Expected client without allow-list to use any model")
+	}
+
+	limited, _ := r.Authenticate("sk-limited")
+	if !limited.AllowsModel("minimaxai/minimax-m2") {
+		t.Error("Expected allowed model to be accepted")
+	}
+	if limited.AllowsModel("meta/llama-3.1-405b-instruct") {
+		t.Error("Expected model outside allow-list to be refused")
+	}
+}
+
+func TestClient_RequestsPerMinute(t *testing.T) {
+	r := NewRegistry([]config.ClientConfig{
+		{Name: "web", Key: "sk-web", RequestsPerMinute: 2},
+	})
+	client, _ := r.Authenticate("sk-web")
+
+	for i := 0; i < 2; i++ {
+		if err := client.Allow(); err != nil {
+			t.Fatalf("Request %d refused: %v", i+1, err)
+		}
+	}
+	if err := client.Allow(); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Expected ErrRateLimited, got %v", err)
+	}
+
+	stats := r.GetStats()
+	if stats[0].RequestCount != 2 || stats[0].Rejected != 1 {
+		t.Errorf("Unexpected stats: %+v", stats[0])
+	}
+}
+
+func TestClient_TokensPerDay(t *testing.T) {
+	r := NewRegistry([]config.ClientConfig{
+		{Name: "batch", Key: "sk-batch", TokensPerDay: 1000},
+	})
+	client, _ := r.Authenticate("sk-batch")
+
+	if err := client.Allow(); err != nil {
+		t.Fatalf("Request refused: %v", err)
+	}
+	client.RecordUsage(600, 400)
+
+	if err := client.Allow(); !errors.Is(err, ErrTokenBudgetExceeded) {
+		t.Errorf("Expected ErrTokenBudgetExceeded, got %v", err)
+	}
+
+	// The budget resets with the day
+	client.mu.Lock()
+	client.day = "2000-01-01"
+	client.mu.Unlock()
+
+	if err := client.Allow(); err != nil {
+		t.Errorf("Expected budget to reset on a new day: %v", err)
+	}
+
+	stats := r.GetStats()
+	if stats[0].TokensToday != 0 || stats[0].TotalTokens != 1000 || stats[0].PromptTokens != 600 {
+		t.Errorf("Unexpected stats: %+v", stats[0])
+	}
+}
+
+func TestRegistry_Reload(t *testing.T) {
+	r := NewRegistry([]config.ClientConfig{
+		{Name: "web", Key: "sk-web"},
+		{Name: "batch", Key: "sk-batch", RequestsPerMinute: 1},
+	})
+	for _, key := range []string{"sk-web", "sk-batch"} {
+		client, _ := r.Authenticate(key)
+		client.Allow()
+	}
+
+	next := r.Reload([]config.ClientConfig{
+		{Name: "web-app", Key: "sk-web"},
+		{Name: "batch", Key: "sk-batch", RequestsPerMinute: 20},
+		{Name: "new", Key: "sk-new"},
+	})
+
+	stats := next.GetStats()
+	if len(stats) != 3 {
+		t.Fatalf("Expected 3 clients, got %d", len(stats))
+	}
+	if stats[0].Name != "web-app" || stats[0].RequestCount != 1 {
+		t.Errorf("Expected renamed client to keep its counters, got %+v", stats[0])
+	}
+	if stats[1].RequestCount != 1 {
+		t.Errorf("Expected changed client to keep its counters, got %d", stats[1].RequestCount)
+	}
+
+	// Raising the limit does not refill the requests already used
+	batch, _ := next.Authenticate("sk-batch")
+	if err := batch.Allow(); err != ErrRateLimited {
+		t.Errorf("Expected the client to stay rate limited, got %v", err)
+	}
+	if _, err := next.Authenticate("sk-new"); err != nil {
+		t.Errorf("Expected new client to authenticate, got %v", err)
+	}
+}
@@ -3,38 +3,402 @@ package config
 import (
 	"fmt"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the application configuration
 type Config struct {
-	Server  ServerConfig  `yaml:"server"`
-	NVIDIA  NVIDIAConfig  `yaml:"nvidia"`
-	Logging LoggingConfig `yaml:"logging"`
+	Server    ServerConfig     `yaml:"server"`
+	NVIDIA    NVIDIAConfig     `yaml:"nvidia"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	Routes    []RouteConfig    `yaml:"routes"`
+	Fallbacks FallbackConfig   `yaml:"fallbacks"`
+	Clients   []ClientConfig   `yaml:"clients"`
+	State     StateConfig      `yaml:"state"`
+	Logging   LoggingConfig    `yaml:"logging"`
+
+	RateLimitStore RateLimitStoreConfig `yaml:"rate_limit_store"`
+	ClientLimits   ClientLimitsConfig   `yaml:"client_limits"`
 }
 
 // ServerConfig contains server-related settings
 type ServerConfig struct {
-	Port int    `yaml:"port"`
-	Host string `yaml:"host"`
+	Port         int    `yaml:"port"`
+	Host         string `yaml:"host"`
+	AdminToken   string `yaml:"admin_token"`
+	DrainTimeout int    `yaml:"drain_timeout"` // seconds to wait for in-flight requests on shutdown
+
+	// Seconds to keep serving after /health starts failing on shutdown, so
+	// load balancers stop sending traffic before the listener closes
+	ShutdownDelay int `yaml:"shutdown_delay"`
+
+	// Serve /stats and /metrics without the admin token even when one is set
+	PublicStats bool `yaml:"public_stats"`
+}
+
+// defaultDrainTimeout is used when drain_timeout is not set
+const defaultDrainTimeout = 30
+
+// defaultShutdownDelay is used when shutdown_delay is not set
+const defaultShutdownDelay = 5
+
+// UpstreamConfig contains settings for an OpenAI-compatible upstream API and
+// its key pool
+type UpstreamConfig struct {
+	Name      string      `yaml:"name"`
+	BaseURL   string      `yaml:"base_url"`
+	RateLimit int         `yaml:"rate_limit"`
+	APIKeys   []string    `yaml:"api_keys"`
+	Timeout   int         `yaml:"timeout"` // seconds for a whole non-streaming response, 0 means no limit
+	Retry     RetryConfig `yaml:"retry"`
+
+	// Keys with their own weight, rate limit or tier, used next to api_keys
+	Keys     []KeyConfig `yaml:"keys"`
+	Strategy string      `yaml:"strategy"` // how keys are picked, round_robin by default
+
+	// How rate_limit is enforced per key, token_bucket by default, and how many
+	// requests a key may send at once, 0 meaning as many as its rate_limit
+	Limiter string `yaml:"limiter"`
+	Burst   int    `yaml:"burst"`
+
+	// Prompt plus completion tokens per minute per key, 0 means no limit
+	TokensPerMinute int `yaml:"tokens_per_minute"`
+
+	// Requests per minute per key for particular models, on top of rate_limit
+	ModelLimits []ModelLimitConfig `yaml:"model_limits"`
+
+	// Requests in flight at once per key, including open streams, 0 means no limit
+	MaxConcurrency int `yaml:"max_concurrency"`
+
+	Timeouts       TimeoutsConfig       `yaml:"timeouts"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Queue          QueueConfig          `yaml:"queue"`
+	Quota          QuotaConfig          `yaml:"quota"`
+	Affinity       AffinityConfig       `yaml:"affinity"`
+}
+
+// NVIDIAConfig is the single-upstream `nvidia` section, kept so existing
+// configuration files keep working
+type NVIDIAConfig = UpstreamConfig
+
+// defaultNVIDIAName is the upstream name given to the legacy `nvidia` section
+const defaultNVIDIAName = "nvidia"
+
+// UnmarshalYAML applies defaults to settings missing from an upstream section
+func (u *UpstreamConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain UpstreamConfig
+	upstream := plain(defaultUpstreamConfig())
+	if err := value.Decode(&upstream); err != nil {
+		return err
+	}
+	*u = UpstreamConfig(upstream)
+	return nil
 }
 
-// NVIDIAConfig contains NVIDIA API related settings
-type NVIDIAConfig struct {
-	BaseURL   string        `yaml:"base_url"`
-	RateLimit int           `yaml:"rate_limit"`
-	APIKeys   []string      `yaml:"api_keys"`
-	Timeout   int           `yaml:"timeout"`
-	Retry     RetryConfig   `yaml:"retry"`
+// KeyConfig describes an API key with settings of its own. Zero values fall
+// back to the upstream's settings.
+type KeyConfig struct {
+	Key       string `yaml:"key"`
+	Weight    int    `yaml:"weight"`     // share of requests under weighted_round_robin, 1 by default
+	RateLimit int    `yaml:"rate_limit"` // requests per minute, the upstream's rate_limit by default
+	Tier      int    `yaml:"tier"`       // lower tiers are used first under tiered, 1 by default
+	Limiter   string `yaml:"limiter"`    // rate limit algorithm, the upstream's limiter by default
+	Burst     int    `yaml:"burst"`      // the upstream's burst by default
+
+	MaxConcurrency int `yaml:"max_concurrency"` // the upstream's max_concurrency by default
+
+	Models      []string           `yaml:"models"`       // glob patterns of the models the key serves, empty serves all
+	ModelLimits []ModelLimitConfig `yaml:"model_limits"` // checked before the upstream's model_limits
+
+	Quota QuotaConfig `yaml:"quota"` // the upstream's quota by default
+}
+
+// ModelLimitConfig sets how many requests per minute each key may send for
+// the models matching a glob pattern
+type ModelLimitConfig struct {
+	Model     string `yaml:"model"`
+	RateLimit int    `yaml:"rate_limit"`
+}
+
+// ServesModel reports whether the key may be used for the model
+func (k KeyConfig) ServesModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, pattern := range k.Models {
+		if globMatch(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// ModelLimit returns the first model limit of the key matching the model,
+// or false when only the key's rate limit applies
+func (k KeyConfig) ModelLimit(model string) (ModelLimitConfig, bool) {
+	for _, limit := range k.ModelLimits {
+		if globMatch(limit.Model, model) {
+			return limit, true
+		}
+	}
+	return ModelLimitConfig{}, false
+}
+
+// Key selection strategies
+const (
+	StrategyRoundRobin          = "round_robin"
+	StrategyWeightedRoundRobin  = "weighted_round_robin"
+	StrategyLeastRecentlyUsed   = "least_recently_used"
+	StrategyMostTokensRemaining = "most_tokens_remaining"
+	StrategyTiered              = "tiered"
+	StrategyLeastLatency        = "least_latency"
+	StrategyPowerOfTwoChoices   = "power_of_two_choices"
+)
+
+// Rate limit algorithms
+const (
+	LimiterTokenBucket   = "token_bucket"
+	LimiterSlidingWindow = "sliding_window"
+	LimiterGCRA          = "gcra"
+)
+
+// KeyConfigs returns every key of the upstream, from both api_keys and keys,
+// with defaults and the upstream's model limits applied
+func (u *UpstreamConfig) KeyConfigs() []KeyConfig {
+	keys := make([]KeyConfig, 0, len(u.APIKeys)+len(u.Keys))
+	for _, key := range u.APIKeys {
+		keys = append(keys, KeyConfig{Key: key})
+	}
+	keys = append(keys, u.Keys...)
+
+	for i := range keys {
+		if keys[i].Weight == 0 {
+			keys[i].Weight = 1
+		}
+		if keys[i].RateLimit == 0 {
+			keys[i].RateLimit = u.RateLimit
+		}
+		if keys[i].Tier == 0 {
+			keys[i].Tier = 1
+		}
+		if keys[i].Limiter == "" {
+			keys[i].Limiter = u.Limiter
+		}
+		if keys[i].Burst == 0 {
+			keys[i].Burst = u.Burst
+		}
+		if keys[i].MaxConcurrency == 0 {
+			keys[i].MaxConcurrency = u.MaxConcurrency
+		}
+		if !keys[i].Quota.Enabled() {
+			keys[i].Quota = u.Quota
+		} else if keys[i].Quota.Timezone == "" {
+			keys[i].Quota.Timezone = u.Quota.Timezone
+		}
+		if len(u.ModelLimits) > 0 {
+			limits := make([]ModelLimitConfig, 0, len(keys[i].ModelLimits)+len(u.ModelLimits))
+			keys[i].ModelLimits = append(append(limits, keys[i].ModelLimits...), u.ModelLimits...)
+		}
+	}
+	return keys
 }
 
 // RetryConfig contains retry-related settings
 type RetryConfig struct {
-	MaxRetries   int  `yaml:"max_retries"`
-	AutoFailover bool `yaml:"auto_failover"`
+	MaxRetries   int  `yaml:"max_retries"`   // distinct keys tried per request
+	AutoFailover bool `yaml:"auto_failover"` // retry 429/5xx/connection errors on another key
+}
+
+// TimeoutsConfig contains the finer grained upstream timeouts, in seconds.
+// Zero disables a timeout.
+type TimeoutsConfig struct {
+	Connect   int `yaml:"connect"`    // establishing the connection, including TLS
+	FirstByte int `yaml:"first_byte"` // until a stream starts; exceeding it fails over to another key
+	Idle      int `yaml:"idle"`       // between chunks of a stream
+}
+
+// CircuitBreakerConfig contains settings for taking failing keys out of rotation
+type CircuitBreakerConfig struct {
+	FailureThreshold int `yaml:"failure_threshold"` // consecutive failures before opening, 0 disables
+	Cooldown         int `yaml:"cooldown"`          // seconds before a trial request is allowed
+}
+
+// QueueConfig contains settings for requests waiting on a rate limited key pool
+type QueueConfig struct {
+	MaxDepth int `yaml:"max_depth"` // maximum waiting requests, 0 means unbounded
+	MaxWait  int `yaml:"max_wait"`  // seconds a request may wait, 0 means until the client gives up
+}
+
+// QuotaConfig contains the daily and monthly budget of each key, e.g. the
+// credits of a trial key. Zero means no limit.
+type QuotaConfig struct {
+	RequestsPerDay   int    `yaml:"requests_per_day"`
+	TokensPerDay     int    `yaml:"tokens_per_day"`
+	RequestsPerMonth int    `yaml:"requests_per_month"`
+	TokensPerMonth   int    `yaml:"tokens_per_month"`
+	Timezone         string `yaml:"timezone"` // IANA name the days and months reset in, UTC by default
+}
+
+// Enabled reports whether any quota is set
+func (q QuotaConfig) Enabled() bool {
+	return q.RequestsPerDay > 0 || q.TokensPerDay > 0 || q.RequestsPerMonth > 0 || q.TokensPerMonth > 0
+}
+
+// validate checks the budgets and timezone of a quota
+func (q QuotaConfig) validate() error {
+	if q.RequestsPerDay < 0 || q.TokensPerDay < 0 || q.RequestsPerMonth < 0 || q.TokensPerMonth < 0 {
+		return fmt.Errorf("quotas must not be negative")
+	}
+	if q.Timezone != "" {
+		if _, err := time.LoadLocation(q.Timezone); err != nil {
+			return fmt.Errorf("invalid quota timezone %q: %w", q.Timezone, err)
+		}
+	}
+	return nil
+}
+
+// Location returns the timezone quotas reset in
+func (q QuotaConfig) Location() *time.Location {
+	if q.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(q.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// AffinityConfig pins requests of the same conversation or client to the
+// same key, so upstream prompt caches get reused
+type AffinityConfig struct {
+	By     []string `yaml:"by"`     // sources tried in order: header, client, messages; empty disables affinity
+	Header string   `yaml:"header"` // request header naming the session
+}
+
+// Affinity sources
+const (
+	AffinityHeader   = "header"
+	AffinityClient   = "client"
+	AffinityMessages = "messages"
+)
+
+// RouteConfig maps requested models to an upstream
+type RouteConfig struct {
+	Match    string `yaml:"match"` // exact (default), prefix or glob
+	Pattern  string `yaml:"pattern"`
+	Upstream string `yaml:"upstream"`
+}
+
+// Route match types
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchGlob   = "glob"
+)
+
+// Matches reports whether the route applies to the model
+func (r RouteConfig) Matches(model string) bool {
+	switch r.Match {
+	case MatchPrefix:
+		return strings.HasPrefix(model, r.Pattern)
+	case MatchGlob:
+		return globMatch(r.Pattern, model)
+	default:
+		return model == r.Pattern
+	}
+}
+
+// globMatch matches a pattern where * matches any run of characters
+// (including "/", which model names often contain) and ? matches one
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
 }
 
+// FallbackConfig maps a model to the models tried, in order, when it is
+// overloaded or has no keys available
+type FallbackConfig map[string][]string
+
+// ClientConfig describes a virtual API key handed out to a client of the proxy
+type ClientConfig struct {
+	Name              string    `yaml:"name"`
+	Key               string    `yaml:"key"`
+	AllowedModels     []string  `yaml:"allowed_models"`      // empty allows every model
+	RequestsPerMinute int       `yaml:"requests_per_minute"` // 0 means unlimited
+	TokensPerDay      int       `yaml:"tokens_per_day"`      // 0 means unlimited
+	ExpiresAt         time.Time `yaml:"expires_at"`          // zero never expires
+}
+
+// ClientLimitsConfig limits how hard each client may use the proxy, in front
+// of the key pools. Zero means no limit.
+type ClientLimitsConfig struct {
+	By                      string `yaml:"by"`                         // key (default), ip or header
+	Header                  string `yaml:"header"`                     // identifies clients when by is header
+	RequestsPerMinute       int    `yaml:"requests_per_minute"`        // per client
+	MaxConcurrency          int    `yaml:"max_concurrency"`            // per client
+	GlobalRequestsPerMinute int    `yaml:"global_requests_per_minute"` // all clients together
+}
+
+// Client identities
+const (
+	ClientByKey    = "key"
+	ClientByIP     = "ip"
+	ClientByHeader = "header"
+)
+
+// StateConfig contains settings for keeping key state across restarts
+type StateConfig struct {
+	Path     string `yaml:"path"`     // JSON file the state is saved to, empty disables persistence
+	Interval int    `yaml:"interval"` // seconds between snapshots
+}
+
+// defaultStateInterval is used when the state interval is not set
+const defaultStateInterval = 30
+
+// RateLimitStoreConfig selects where key rate limit buckets are kept. A
+// shared store lets several proxy replicas enforce the limits together.
+type RateLimitStoreConfig struct {
+	Type     string `yaml:"type"`    // local (default) or redis
+	Address  string `yaml:"address"` // host:port of the Redis server
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	Prefix   string `yaml:"prefix"` // prepended to bucket names, default "proxypal"
+}
+
+// Rate limit store types
+const (
+	RateLimitStoreLocal = "local"
+	RateLimitStoreRedis = "redis"
+)
+
+// defaultRateLimitStorePrefix is used when the store prefix is not set
+const defaultRateLimitStorePrefix = "proxypal"
+
 // LoggingConfig contains logging-related settings
 type LoggingConfig struct {
 	Level            string `yaml:"level"`
@@ -48,7 +412,12 @@ func LoadConfig(filepath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	var config Config
+	config := Config{
+		Server: ServerConfig{DrainTimeout: defaultDrainTimeout, ShutdownDelay: defaultShutdownDelay},
+		State:  StateConfig{Interval: defaultStateInterval},
+
+		RateLimitStore: RateLimitStoreConfig{Prefix: defaultRateLimitStorePrefix},
+	}
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
@@ -61,22 +430,278 @@ func LoadConfig(filepath string) (*Config, error) {
 	return &config, nil
 }
 
+// defaultUpstreamConfig returns the values used for settings missing from an
+// upstream section
+func defaultUpstreamConfig() UpstreamConfig {
+	return UpstreamConfig{
+		Retry: RetryConfig{
+			MaxRetries:   3,
+			AutoFailover: true,
+		},
+		Timeouts: TimeoutsConfig{
+			Connect:   10,
+			FirstByte: 60,
+			Idle:      60,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 5,
+			Cooldown:         30,
+		},
+		Queue: QueueConfig{
+			MaxDepth: 100,
+			MaxWait:  30,
+		},
+		Affinity: AffinityConfig{
+			Header: "X-Session-ID",
+		},
+	}
+}
+
+// GetUpstreams returns the configured upstreams. A config with only the
+// legacy `nvidia` section yields a single upstream named "nvidia".
+func (c *Config) GetUpstreams() []UpstreamConfig {
+	if len(c.Upstreams) > 0 {
+		return c.Upstreams
+	}
+
+	nvidia := c.NVIDIA
+	if nvidia.Name == "" {
+		nvidia.Name = defaultNVIDIAName
+	}
+	return []UpstreamConfig{nvidia}
+}
+
+// ResolveUpstream returns the name of the upstream serving a model: the first
+// matching route, or the first upstream when no route matches
+func (c *Config) ResolveUpstream(model string) string {
+	for _, route := range c.Routes {
+		if route.Matches(model) {
+			return route.Upstream
+		}
+	}
+	return c.GetUpstreams()[0].Name
+}
+
+// NamesModel reports whether the configuration names the model exactly: in
+// an exact route, a fallback chain or a client's allowed models
+func (c *Config) NamesModel(model string) bool {
+	for _, route := range c.Routes {
+		if (route.Match == "" || route.Match == MatchExact) && route.Pattern == model {
+			return true
+		}
+	}
+	for from, fallbacks := range c.Fallbacks {
+		if from == model || slices.Contains(fallbacks, model) {
+			return true
+		}
+	}
+	for _, client := range c.Clients {
+		if slices.Contains(client.AllowedModels, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// FallbackChain returns the model followed by its configured fallbacks
+func (c *Config) FallbackChain(model string) []string {
+	return append([]string{model}, c.Fallbacks[model]...)
+}
+
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
 	if c.Server.Port <= 0 || c.Server.Port > 65535 {
 		return fmt.Errorf("invalid server port: %d", c.Server.Port)
 	}
 
-	if len(c.NVIDIA.APIKeys) == 0 {
-		return fmt.Errorf("at least one NVIDIA API key is required")
+	if c.Server.DrainTimeout < 0 || c.Server.ShutdownDelay < 0 {
+		return fmt.Errorf("drain timeout and shutdown delay must not be negative")
+	}
+
+	if c.State.Path != "" && c.State.Interval <= 0 {
+		return fmt.Errorf("state interval must be positive")
 	}
 
-	if c.NVIDIA.RateLimit <= 0 {
+	switch c.RateLimitStore.Type {
+	case "", RateLimitStoreLocal:
+	case RateLimitStoreRedis:
+		if c.RateLimitStore.Address == "" {
+			return fmt.Errorf("rate limit store address is required for redis")
+		}
+	default:
+		return fmt.Errorf("unknown rate limit store type %q", c.RateLimitStore.Type)
+	}
+
+	limits := c.ClientLimits
+	switch limits.By {
+	case "", ClientByKey, ClientByIP:
+	case ClientByHeader:
+		if limits.Header == "" {
+			return fmt.Errorf("client limits header is required when clients are identified by header")
+		}
+	default:
+		return fmt.Errorf("unknown client identity %q", limits.By)
+	}
+	if limits.RequestsPerMinute < 0 || limits.MaxConcurrency < 0 || limits.GlobalRequestsPerMinute < 0 {
+		return fmt.Errorf("client limits must not be negative")
+	}
+
+	if len(c.Upstreams) > 0 && (c.NVIDIA.BaseURL != "" || len(c.NVIDIA.KeyConfigs()) > 0) {
+		return fmt.Errorf("use either the nvidia section or upstreams, not both")
+	}
+
+	upstreams := make(map[string]bool)
+	for _, upstream := range c.GetUpstreams() {
+		if upstream.Name == "" {
+			return fmt.Errorf("upstream name is required")
+		}
+		if upstreams[upstream.Name] {
+			return fmt.Errorf("upstream %q: duplicate name", upstream.Name)
+		}
+		if err := upstream.Validate(); err != nil {
+			return fmt.Errorf("upstream %q: %w", upstream.Name, err)
+		}
+		// Shared buckets are plain token buckets holding rate_limit requests
+		if c.RateLimitStore.Type == RateLimitStoreRedis {
+			for i, key := range upstream.KeyConfigs() {
+				if (key.Limiter != "" && key.Limiter != LimiterTokenBucket) || key.Burst != 0 {
+					return fmt.Errorf("upstream %q: key %d: limiter and burst are not supported with the redis rate limit store", upstream.Name, i)
+				}
+			}
+		}
+		upstreams[upstream.Name] = true
+	}
+
+	for i, route := range c.Routes {
+		switch route.Match {
+		case "", MatchExact, MatchPrefix, MatchGlob:
+		default:
+			return fmt.Errorf("route %d: unknown match type %q", i, route.Match)
+		}
+		if route.Pattern == "" {
+			return fmt.Errorf("route %d: pattern is required", i)
+		}
+		if !upstreams[route.Upstream] {
+			return fmt.Errorf("route %d: unknown upstream %q", i, route.Upstream)
+		}
+	}
+
+	for model, fallbacks := range c.Fallbacks {
+		for _, fallback := range fallbacks {
+			if fallback == "" {
+				return fmt.Errorf("fallbacks for %q: model name is required", model)
+			}
+			if fallback == model {
+				return fmt.Errorf("fallbacks for %q: model cannot fall back to itself", model)
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	for i, client := range c.Clients {
+		if client.Name == "" {
+			return fmt.Errorf("client %d: name is required", i)
+		}
+		if client.Key == "" {
+			return fmt.Errorf("client %q: key is required", client.Name)
+		}
+		if names[client.Name] {
+			return fmt.Errorf("client %q: duplicate name", client.Name)
+		}
+		if keys[client.Key] {
+			return fmt.Errorf("client %q: duplicate key", client.Name)
+		}
+		if client.RequestsPerMinute < 0 || client.TokensPerDay < 0 {
+			return fmt.Errorf("client %q: budgets must not be negative", client.Name)
+		}
+		names[client.Name] = true
+		keys[client.Key] = true
+	}
+
+	return nil
+}
+
+// Validate checks if the upstream settings are valid
+func (u *UpstreamConfig) Validate() error {
+	keys := u.KeyConfigs()
+	if len(keys) == 0 {
+		return fmt.Errorf("at least one API key is required")
+	}
+
+	if u.RateLimit <= 0 {
 		return fmt.Errorf("rate limit must be positive")
 	}
 
-	if c.NVIDIA.BaseURL == "" {
-		return fmt.Errorf("NVIDIA base URL is required")
+	if err := u.Quota.validate(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		if key.Key == "" {
+			return fmt.Errorf("key %d: key is required", i)
+		}
+		if seen[key.Key] {
+			return fmt.Errorf("key %d: duplicate key", i)
+		}
+		seen[key.Key] = true
+
+		if key.Weight < 0 || key.RateLimit < 0 || key.Burst < 0 || key.Tier < 0 || key.MaxConcurrency < 0 {
+			return fmt.Errorf("key %d: weight, rate limit, burst, tier and max concurrency must not be negative", i)
+		}
+		switch key.Limiter {
+		case "", LimiterTokenBucket, LimiterSlidingWindow, LimiterGCRA:
+		default:
+			return fmt.Errorf("key %d: unknown rate limiter %q", i, key.Limiter)
+		}
+		// A sliding window never lets more than rate_limit through in a minute
+		if key.Limiter == LimiterSlidingWindow && key.Burst != 0 {
+			return fmt.Errorf("key %d: burst is not supported with the sliding_window limiter", i)
+		}
+		for _, limit := range key.ModelLimits {
+			if limit.Model == "" || limit.RateLimit <= 0 {
+				return fmt.Errorf("key %d: model limits need a model and a positive rate limit", i)
+			}
+		}
+		if err := key.Quota.validate(); err != nil {
+			return fmt.Errorf("key %d: %w", i, err)
+		}
+	}
+
+	switch u.Strategy {
+	case "", StrategyRoundRobin, StrategyWeightedRoundRobin, StrategyLeastRecentlyUsed,
+		StrategyMostTokensRemaining, StrategyTiered, StrategyLeastLatency, StrategyPowerOfTwoChoices:
+	default:
+		return fmt.Errorf("unknown key strategy %q", u.Strategy)
+	}
+
+	if u.TokensPerMinute < 0 {
+		return fmt.Errorf("tokens per minute must not be negative")
+	}
+
+	if u.BaseURL == "" {
+		return fmt.Errorf("base URL is required")
+	}
+
+	if u.CircuitBreaker.FailureThreshold > 0 && u.CircuitBreaker.Cooldown <= 0 {
+		return fmt.Errorf("circuit breaker cooldown must be positive")
+	}
+
+	if u.Timeout < 0 || u.Timeouts.Connect < 0 || u.Timeouts.FirstByte < 0 || u.Timeouts.Idle < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+
+	if u.Queue.MaxDepth < 0 || u.Queue.MaxWait < 0 {
+		return fmt.Errorf("queue limits must not be negative")
+	}
+
+	for _, source := range u.Affinity.By {
+		switch source {
+		case AffinityHeader, AffinityClient, AffinityMessages:
+		default:
+			return fmt.Errorf("unknown affinity source %q", source)
+		}
 	}
 
 	return nil
@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -59,6 +61,30 @@ logging:
 	if cfg.NVIDIA.RateLimit != 40 {
 		t.Errorf("Expected rate limit 40, got %d", cfg.NVIDIA.RateLimit)
 	}
+
+	if cfg.Server.DrainTimeout != 30 {
+		t.Errorf("Expected default drain timeout 30, got %d", cfg.Server.DrainTimeout)
+	}
+	if cfg.Server.ShutdownDelay != 5 {
+		t.Errorf("Expected default shutdown delay 5, got %d", cfg.Server.ShutdownDelay)
+	}
+	if cfg.State.Interval != 30 {
+		t.Errorf("Expected default state interval 30, got %d", cfg.State.Interval)
+	}
+
+	// Timeouts are not set in the file, so defaults apply
+	if cfg.NVIDIA.Timeouts.FirstByte != 60 || cfg.NVIDIA.Timeouts.Idle != 60 {
+		t.Errorf("Expected default first byte and idle timeouts of 60, got %+v", cfg.NVIDIA.Timeouts)
+	}
+
+	// Circuit breaker is not set in the file, so defaults apply
+	if cfg.NVIDIA.CircuitBreaker.FailureThreshold != 5 {
+		t.Errorf("Expected default failure threshold 5, got %d", cfg.NVIDIA.CircuitBreaker.FailureThreshold)
+	}
+
+	if cfg.NVIDIA.CircuitBreaker.Cooldown != 30 {
+		t.Errorf("Expected default cooldown 30, got %d", cfg.NVIDIA.CircuitBreaker.Cooldown)
+	}
 }
 
 func TestLoadConfig_InvalidFile(t *testing.T) {
@@ -122,6 +148,293 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "keys with settings only",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					Keys:      []KeyConfig{{Key: "key1", Weight: 3, Tier: 1}, {Key: "key2", Tier: 2}},
+					Strategy:  StrategyTiered,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "duplicate key",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+					Keys:      []KeyConfig{{Key: "key1", Weight: 2}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative key weight",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					Keys:      []KeyConfig{{Key: "key1", Weight: -1}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown key strategy",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+					Strategy:  "random",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown rate limiter",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+					Keys:      []KeyConfig{{Key: "key2", Limiter: "leaky_bucket"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "model limit without rate limit",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:     "https://api.nvidia.com",
+					RateLimit:   40,
+					APIKeys:     []string{"key1"},
+					ModelLimits: []ModelLimitConfig{{Model: "meta/*"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative max concurrency",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:        "https://api.nvidia.com",
+					RateLimit:      40,
+					APIKeys:        []string{"key1"},
+					MaxConcurrency: -1,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "client limits by header without header",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+				},
+				ClientLimits: ClientLimitsConfig{By: ClientByHeader, RequestsPerMinute: 10},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown affinity source",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+					Affinity:  AffinityConfig{By: []string{"cookie"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative tokens per minute",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:         "https://api.nvidia.com",
+					RateLimit:       40,
+					APIKeys:         []string{"key1"},
+					TokensPerMinute: -1,
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "state without interval",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+				},
+				State: StateConfig{Path: "state.json"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "redis rate limit store without address",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+				},
+				RateLimitStore: RateLimitStoreConfig{Type: "redis"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "burst with the redis rate limit store",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					Burst:     5,
+					APIKeys:   []string{"key1"},
+				},
+				RateLimitStore: RateLimitStoreConfig{Type: "redis", Address: "redis:6379"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "burst with the sliding window limiter",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+					Keys:      []KeyConfig{{Key: "key2", Limiter: LimiterSlidingWindow, Burst: 5}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown rate limit store",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+				},
+				RateLimitStore: RateLimitStoreConfig{Type: "memcached"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid quota timezone",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+					Quota:     QuotaConfig{RequestsPerDay: 100, Timezone: "Mars/Olympus_Mons"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "client without key",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+				},
+				Clients: []ClientConfig{{Name: "web"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate client key",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+				},
+				Clients: []ClientConfig{
+					{Name: "web", Key: "sk-shared"},
+					{Name: "batch", Key: "sk-shared"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "nvidia section and upstreams",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+				},
+				Upstreams: []UpstreamConfig{
+					{Name: "local", BaseURL: "http://localhost:8000/v1", RateLimit: 40, APIKeys: []string{"EMPTY"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate upstream name",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				Upstreams: []UpstreamConfig{
+					{Name: "local", BaseURL: "http://localhost:8000/v1", RateLimit: 40, APIKeys: []string{"EMPTY"}},
+					{Name: "local", BaseURL: "http://localhost:8001/v1", RateLimit: 40, APIKeys: []string{"EMPTY"}},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "route to unknown upstream",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				Upstreams: []UpstreamConfig{
+					{Name: "local", BaseURL: "http://localhost:8000/v1", RateLimit: 40, APIKeys: []string{"EMPTY"}},
+				},
+				Routes: []RouteConfig{{Pattern: "qwen2.5-coder", Upstream: "openrouter"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "model falls back to itself",
+			config: Config{
+				Server: ServerConfig{Port: 8080, Host: "0.0.0.0"},
+				NVIDIA: NVIDIAConfig{
+					BaseURL:   "https://api.nvidia.com",
+					RateLimit: 40,
+					APIKeys:   []string{"key1"},
+				},
+				Fallbacks: FallbackConfig{"minimaxai/minimax-m2": {"minimaxai/minimax-m2"}},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -147,3 +460,197 @@ func TestConfig_GetAddress(t *testing.T) {
 		t.Errorf("GetAddress() = %s, expected %s", addr, expected)
 	}
 }
+
+func TestLoadConfig_Upstreams(t *testing.T) {
+	content := `
+server:
+  port: 8080
+
+upstreams:
+  - name: nvidia
+    base_url: "https://integrate.api.nvidia.com/v1"
+    rate_limit: 40
+    api_keys: ["nvapi-key1"]
+  - name: local
+    base_url: "http://localhost:8000/v1"
+    rate_limit: 1000
+    api_keys: ["EMPTY"]
+    retry:
+      max_retries: 1
+
+routes:
+  - match: glob
+    pattern: "qwen*"
+    upstream: local
+`
+
+	tmpfile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	upstreams := cfg.GetUpstreams()
+	if len(upstreams) != 2 {
+		t.Fatalf("Expected 2 upstreams, got %d", len(upstreams))
+	}
+
+	// Defaults apply per upstream, overrides stay local to it
+	if upstreams[0].Retry.MaxRetries != 3 {
+		t.Errorf("Expected default max retries 3, got %d", upstreams[0].Retry.MaxRetries)
+	}
+	if upstreams[1].Retry.MaxRetries != 1 {
+		t.Errorf("Expected max retries 1, got %d", upstreams[1].Retry.MaxRetries)
+	}
+	if upstreams[1].CircuitBreaker.FailureThreshold != 5 {
+		t.Errorf("Expected default failure threshold 5, got %d", upstreams[1].CircuitBreaker.FailureThreshold)
+	}
+}
+
+func TestUpstreamConfig_KeyConfigs(t *testing.T) {
+	u := &UpstreamConfig{
+		RateLimit: 40,
+		Limiter:   LimiterGCRA,
+		Burst:     10,
+		APIKeys:   []string{"key1"},
+		Keys:      []KeyConfig{{Key: "key2", Weight: 3, RateLimit: 100, Tier: 2, Limiter: LimiterSlidingWindow, Burst: 20}},
+	}
+
+	keys := u.KeyConfigs()
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(keys))
+	}
+	if want := (KeyConfig{Key: "key1", Weight: 1, RateLimit: 40, Tier: 1, Limiter: LimiterGCRA, Burst: 10}); !reflect.DeepEqual(keys[0], want) {
+		t.Errorf("Expected defaults %+v, got %+v", want, keys[0])
+	}
+	if want := (KeyConfig{Key: "key2", Weight: 3, RateLimit: 100, Tier: 2, Limiter: LimiterSlidingWindow, Burst: 20}); !reflect.DeepEqual(keys[1], want) {
+		t.Errorf("Expected %+v, got %+v", want, keys[1])
+	}
+}
+
+func TestUpstreamConfig_KeyQuota(t *testing.T) {
+	u := &UpstreamConfig{
+		RateLimit: 40,
+		Quota:     QuotaConfig{RequestsPerDay: 1000, Timezone: "Asia/Ho_Chi_Minh"},
+		Keys: []KeyConfig{
+			{Key: "key1"},
+			{Key: "key2", Quota: QuotaConfig{TokensPerMonth: 50000}},
+		},
+	}
+
+	keys := u.KeyConfigs()
+	if keys[0].Quota != u.Quota {
+		t.Errorf("Expected the upstream's quota by default, got %+v", keys[0].Quota)
+	}
+	if want := (QuotaConfig{TokensPerMonth: 50000, Timezone: "Asia/Ho_Chi_Minh"}); keys[1].Quota != want {
+		t.Errorf("Expected the key's own quota in the upstream's timezone %+v, got %+v", want, keys[1].Quota)
+	}
+
+	u.Keys[1].Quota.RequestsPerDay = -1
+	if err := u.Validate(); err == nil {
+		t.Error("Expected a negative key quota to be rejected")
+	}
+}
+
+func TestKeyConfig_Models(t *testing.T) {
+	u := &UpstreamConfig{
+		RateLimit:   40,
+		ModelLimits: []ModelLimitConfig{{Model: "meta/llama-3.1-405b*", RateLimit: 5}},
+		Keys: []KeyConfig{{
+			Key:         "key1",
+			Models:      []string{"meta/*"},
+			ModelLimits: []ModelLimitConfig{{Model: "meta/llama-3.1-405b-instruct", RateLimit: 2}},
+		}},
+	}
+	key := u.KeyConfigs()[0]
+
+	if !key.ServesModel("meta/llama-3.1-8b-instruct") || key.ServesModel("mistralai/mixtral-8x22b") {
+		t.Errorf("Expected the key to serve only meta models")
+	}
+
+	// The key's own limits come before the upstream's
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{"meta/llama-3.1-405b-instruct", 2},
+		{"meta/llama-3.1-405b-base", 5},
+		{"meta/llama-3.1-8b-instruct", 0},
+	}
+	for _, tt := range tests {
+		if got, _ := key.ModelLimit(tt.model); got.RateLimit != tt.want {
+			t.Errorf("ModelLimit(%q) has rate limit %d, expected %d", tt.model, got.RateLimit, tt.want)
+		}
+	}
+}
+
+func TestConfig_GetUpstreams_LegacyNVIDIA(t *testing.T) {
+	cfg := &Config{NVIDIA: NVIDIAConfig{BaseURL: "https://api.nvidia.com", APIKeys: []string{"key1"}}}
+
+	upstreams := cfg.GetUpstreams()
+	if len(upstreams) != 1 || upstreams[0].Name != "nvidia" {
+		t.Fatalf("Expected a single upstream named nvidia, got %+v", upstreams)
+	}
+	if upstream := cfg.ResolveUpstream("any-model"); upstream != "nvidia" {
+		t.Errorf("Expected nvidia, got %s", upstream)
+	}
+}
+
+func TestConfig_ResolveUpstream(t *testing.T) {
+	cfg := &Config{
+		Upstreams: []UpstreamConfig{{Name: "nvidia"}, {Name: "openrouter"}, {Name: "local"}},
+		Routes: []RouteConfig{
+			{Pattern: "qwen2.5-coder", Upstream: "local"},
+			{Match: MatchPrefix, Pattern: "anthropic/", Upstream: "openrouter"},
+			{Match: MatchGlob, Pattern: "*/llama-*-instruct", Upstream: "local"},
+		},
+	}
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"qwen2.5-coder", "local"},
+		{"qwen2.5-coder-32b", "nvidia"},
+		{"anthropic/claude-3.5-sonnet", "openrouter"},
+		{"meta/llama-3.1-8b-instruct", "local"},
+		{"meta/llama-3.1-8b-base", "nvidia"},
+		{"minimaxai/minimax-m2", "nvidia"},
+	}
+
+	for _, tt := range tests {
+		if got := cfg.ResolveUpstream(tt.model); got != tt.want {
+			t.Errorf("ResolveUpstream(%q) = %s, expected %s", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestConfig_FallbackChain(t *testing.T) {
+	cfg := &Config{
+		Fallbacks: FallbackConfig{
+			"minimaxai/minimax-m2": {"meta/llama-3.1-70b-instruct", "meta/llama-3.1-8b-instruct"},
+		},
+	}
+
+	chain := cfg.FallbackChain("minimaxai/minimax-m2")
+	expected := []string{"minimaxai/minimax-m2", "meta/llama-3.1-70b-instruct", "meta/llama-3.1-8b-instruct"}
+	if strings.Join(chain, ",") != strings.Join(expected, ",") {
+		t.Errorf("FallbackChain() = %v, expected %v", chain, expected)
+	}
+
+	if chain := cfg.FallbackChain("other"); len(chain) != 1 || chain[0] != "other" {
+		t.Errorf("Expected a model without fallbacks to yield only itself, got %v", chain)
+	}
+}
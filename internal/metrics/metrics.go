@@ -0,0 +1,250 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "proxypal"
+
+// StatsSource provides per-key statistics to export, grouped by upstream name
+type StatsSource interface {
+	UpstreamStats() map[string][]balancer.KeyStats
+}
+
+// Metrics holds the Prometheus collectors exported on /metrics
+type Metrics struct {
+	registry        *prometheus.Registry
+	modelRequests   *prometheus.CounterVec
+	modelFallbacks  *prometheus.CounterVec
+	upstreamStatus  *prometheus.CounterVec
+	timeToFirstByte *prometheus.HistogramVec
+	requestDuration *prometheus.HistogramVec
+	cancellations   *prometheus.CounterVec
+	upstreamTimeout *prometheus.CounterVec
+	modelTokens     *prometheus.CounterVec
+	clientTokens    *prometheus.CounterVec
+	clientThrottled *prometheus.CounterVec
+}
+
+// New creates the proxy metrics and registers a collector for the given key stats
+func New(source StatsSource) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		modelRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "model_requests_total",
+			Help:      "Chat completion requests received, by requested model (\"other\" for models never served).",
+		}, []string{"model"}),
+		modelFallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "model_fallbacks_total",
+			Help:      "Chat completions handed to a fallback model, by requested and fallback model.",
+		}, []string{"model", "fallback"}),
+		upstreamStatus: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_responses_total",
+			Help:      "Responses received from upstream APIs, by upstream and status code.",
+		}, []string{"upstream", "code"}),
+		timeToFirstByte: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_time_to_first_byte_seconds",
+			Help:      "Time from dispatching a chat completion until upstream response headers arrive.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"upstream", "stream"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Total time spent serving a chat completion, including streaming.",
+			Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"stream"}),
+		cancellations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_cancellations_total",
+			Help:      "Chat completions abandoned because the client disconnected.",
+		}, []string{"stream"}),
+		upstreamTimeout: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_timeouts_total",
+			Help:      "Streams abandoned because an upstream was too slow, by upstream and timeout kind.",
+		}, []string{"upstream", "kind"}),
+		modelTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "model_tokens_total",
+			Help:      "Tokens reported by upstream APIs, by serving model and type (prompt or completion).",
+		}, []string{"model", "type"}),
+		clientTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_tokens_total",
+			Help:      "Tokens used by virtual API key clients, by client and type (prompt or completion).",
+		}, []string{"client", "type"}),
+		clientThrottled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_throttled_total",
+			Help:      "Requests refused by the client limits, by reason (rate, concurrency or global).",
+		}, []string{"reason"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newKeyCollector(source),
+		m.modelRequests,
+		m.modelFallbacks,
+		m.upstreamStatus,
+		m.timeToFirstByte,
+		m.requestDuration,
+		m.cancellations,
+		m.upstreamTimeout,
+		m.modelTokens,
+		m.clientTokens,
+		m.clientThrottled,
+	)
+
+	return m
+}
+
+// Handler returns the HTTP handler serving the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveModelRequest counts a chat completion request for a model
+func (m *Metrics) ObserveModelRequest(model string) {
+	m.modelRequests.WithLabelValues(model).Inc()
+}
+
+// ObserveFallback counts a chat completion handed from a model to a fallback
+func (m *Metrics) ObserveFallback(model, fallback string) {
+	m.modelFallbacks.WithLabelValues(model, fallback).Inc()
+}
+
+// ObserveUpstreamStatus counts a response status code returned by an upstream API
+func (m *Metrics) ObserveUpstreamStatus(upstream string, code int) {
+	m.upstreamStatus.WithLabelValues(upstream, strconv.Itoa(code)).Inc()
+}
+
+// ObserveTimeToFirstByte records how long an upstream took to return headers
+func (m *Metrics) ObserveTimeToFirstByte(upstream string, streaming bool, d time.Duration) {
+	m.timeToFirstByte.WithLabelValues(upstream, strconv.FormatBool(streaming)).Observe(d.Seconds())
+}
+
+// ObserveRequestDuration records the total time spent serving a chat completion
+func (m *Metrics) ObserveRequestDuration(streaming bool, d time.Duration) {
+	m.requestDuration.WithLabelValues(strconv.FormatBool(streaming)).Observe(d.Seconds())
+}
+
+// ObserveCancellation counts a chat completion the client disconnected from
+func (m *Metrics) ObserveCancellation(streaming bool) {
+	m.cancellations.WithLabelValues(strconv.FormatBool(streaming)).Inc()
+}
+
+// ObserveUpstreamTimeout counts a first byte or idle timeout hit on an upstream
+func (m *Metrics) ObserveUpstreamTimeout(upstream, kind string) {
+	m.upstreamTimeout.WithLabelValues(upstream, kind).Inc()
+}
+
+// ObserveModelTokens counts the prompt and completion tokens used by a model
+func (m *Metrics) ObserveModelTokens(model string, prompt, completion int) {
+	m.modelTokens.WithLabelValues(model, "prompt").Add(float64(prompt))
+	m.modelTokens.WithLabelValues(model, "completion").Add(float64(completion))
+}
+
+// ObserveClientTokens counts the prompt and completion tokens used by a client
+func (m *Metrics) ObserveClientTokens(client string, prompt, completion int) {
+	m.clientTokens.WithLabelValues(client, "prompt").Add(float64(prompt))
+	m.clientTokens.WithLabelValues(client, "completion").Add(float64(completion))
+}
+
+// ObserveClientThrottled counts a request refused by the client limits
+func (m *Metrics) ObserveClientThrottled(reason string) {
+	m.clientThrottled.WithLabelValues(reason).Inc()
+}
+
+// keyCollector exports per-key counters straight from the load balancers so
+// the numbers always agree with /stats
+type keyCollector struct {
+	source        StatsSource
+	requestsDesc  *prometheus.Desc
+	errorsDesc    *prometheus.Desc
+	availableDesc *prometheus.Desc
+	disabledDesc  *prometheus.Desc
+	tokensDesc    *prometheus.Desc
+	inFlightDesc  *prometheus.Desc
+}
+
+func newKeyCollector(source StatsSource) *keyCollector {
+	return &keyCollector{
+		source: source,
+		requestsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "key", "requests_total"),
+			"Requests dispatched with an API key.",
+			[]string{"upstream", "key", "key_id"}, nil,
+		),
+		errorsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "key", "errors_total"),
+			"Upstream errors recorded against an API key.",
+			[]string{"upstream", "key", "key_id"}, nil,
+		),
+		availableDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "key", "available_tokens"),
+			"Rate limiter tokens currently available for an API key.",
+			[]string{"upstream", "key", "key_id"}, nil,
+		),
+		disabledDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "key", "disabled"),
+			"Whether an API key has been quarantined after an upstream auth failure.",
+			[]string{"upstream", "key", "key_id"}, nil,
+		),
+		tokensDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "key", "tokens_total"),
+			"Tokens reported by upstream for requests sent with an API key, by type (prompt or completion).",
+			[]string{"upstream", "key", "key_id", "type"}, nil,
+		),
+		inFlightDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "key", "in_flight"),
+			"Requests currently in flight on an API key, including open streams.",
+			[]string{"upstream", "key", "key_id"}, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (kc *keyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- kc.requestsDesc
+	ch <- kc.errorsDesc
+	ch <- kc.availableDesc
+	ch <- kc.disabledDesc
+	ch <- kc.tokensDesc
+	ch <- kc.inFlightDesc
+}
+
+// Collect implements prometheus.Collector
+func (kc *keyCollector) Collect(ch chan<- prometheus.Metric) {
+	for upstream, stats := range kc.source.UpstreamStats() {
+		for _, s := range stats {
+			// KeyPrefix is already masked by the balancer, never the raw key, and
+			// KeyID tells apart keys that mask the same
+			ch <- prometheus.MustNewConstMetric(kc.requestsDesc, prometheus.CounterValue, float64(s.RequestCount), upstream, s.KeyPrefix, s.KeyID)
+			ch <- prometheus.MustNewConstMetric(kc.errorsDesc, prometheus.CounterValue, float64(s.ErrorCount), upstream, s.KeyPrefix, s.KeyID)
+			ch <- prometheus.MustNewConstMetric(kc.availableDesc, prometheus.GaugeValue, float64(s.AvailableTokens), upstream, s.KeyPrefix, s.KeyID)
+			ch <- prometheus.MustNewConstMetric(kc.disabledDesc, prometheus.GaugeValue, boolToFloat(s.Disabled), upstream, s.KeyPrefix, s.KeyID)
+			ch <- prometheus.MustNewConstMetric(kc.tokensDesc, prometheus.CounterValue, float64(s.PromptTokens), upstream, s.KeyPrefix, s.KeyID, "prompt")
+			ch <- prometheus.MustNewConstMetric(kc.tokensDesc, prometheus.CounterValue, float64(s.CompletionTokens), upstream, s.KeyPrefix, s.KeyID, "completion")
+			ch <- prometheus.MustNewConstMetric(kc.inFlightDesc, prometheus.GaugeValue, float64(s.InFlight), upstream, s.KeyPrefix, s.KeyID)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
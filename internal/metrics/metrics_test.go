@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+)
+
+type fakeSource struct {
+	stats map[string][]balancer.KeyStats
+}
+
+func (f *fakeSource) UpstreamStats() map[string][]balancer.KeyStats {
+	return f.stats
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetrics_KeyCollector(t *testing.T) {
+	source := &fakeSource{stats: map[string][]balancer.KeyStats{
+		"nvidia": {
+			{
+				KeyPrefix:       balancer.MaskAPIKey("nvapi-1234567890abcdef"),
+				KeyID:           "0123abcd",
+				RequestCount:    12,
+				ErrorCount:      3,
+				AvailableTokens: 28,
+				PromptTokens:    900,
+				InFlight:        2,
+			},
+		},
+	}}
+
+	body := scrape(t, New(source))
+
+	expected := []string{
+		`proxypal_key_requests_total{key="nvapi-...cdef",key_id="0123abcd",upstream="nvidia"} 12`,
+		`proxypal_key_errors_total{key="nvapi-...cdef",key_id="0123abcd",upstream="nvidia"} 3`,
+		`proxypal_key_available_tokens{key="nvapi-...cdef",key_id="0123abcd",upstream="nvidia"} 28`,
+		`proxypal_key_tokens_total{key="nvapi-...cdef",key_id="0123abcd",type="prompt",upstream="nvidia"} 900`,
+		`proxypal_key_in_flight{key="nvapi-...cdef",key_id="0123abcd",upstream="nvidia"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q", line)
+		}
+	}
+
+	if strings.Contains(body, "1234567890") {
+		t.Error("Metrics must not expose the raw API key")
+	}
+}
+
+func TestMetrics_KeysMaskedAlike(t *testing.T) {
+	source := &fakeSource{stats: map[string][]balancer.KeyStats{
+		"nvidia": {
+			{KeyPrefix: balancer.MaskAPIKey("key1"), KeyID: "0123abcd", RequestCount: 1},
+			{KeyPrefix: balancer.MaskAPIKey("key2"), KeyID: "4567ef01", RequestCount: 2},
+		},
+	}}
+
+	rec := httptest.NewRecorder()
+	New(source).Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected keys masked alike to be exported, got %d", rec.Code)
+	}
+	for _, line := range []string{
+		`proxypal_key_requests_total{key="***",key_id="0123abcd",upstream="nvidia"} 1`,
+		`proxypal_key_requests_total{key="***",key_id="4567ef01",upstream="nvidia"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("Expected metrics to contain %q", line)
+		}
+	}
+}
+
+func TestMetrics_Observe(t *testing.T) {
+	m := New(&fakeSource{})
+
+	m.ObserveModelRequest("minimaxai/minimax-m2")
+	m.ObserveModelRequest("minimaxai/minimax-m2")
+	m.ObserveFallback("minimaxai/minimax-m2", "meta/llama-3.1-8b-instruct")
+	m.ObserveUpstreamStatus("nvidia", 429)
+	m.ObserveTimeToFirstByte("nvidia", true, 200*time.Millisecond)
+	m.ObserveRequestDuration(false, 2*time.Second)
+	m.ObserveCancellation(true)
+	m.ObserveUpstreamTimeout("nvidia", "idle")
+	m.ObserveModelTokens("minimaxai/minimax-m2", 10, 5)
+	m.ObserveClientTokens("web", 10, 5)
+
+	body := scrape(t, m)
+
+	expected := []string{
+		`proxypal_model_requests_total{model="minimaxai/minimax-m2"} 2`,
+		`proxypal_model_fallbacks_total{fallback="meta/llama-3.1-8b-instruct",model="minimaxai/minimax-m2"} 1`,
+		`proxypal_upstream_responses_total{code="429",upstream="nvidia"} 1`,
+		`proxypal_upstream_time_to_first_byte_seconds_count{stream="true",upstream="nvidia"} 1`,
+		`proxypal_request_duration_seconds_count{stream="false"} 1`,
+		`proxypal_client_cancellations_total{stream="true"} 1`,
+		`proxypal_upstream_timeouts_total{kind="idle",upstream="nvidia"} 1`,
+		`proxypal_model_tokens_total{model="minimaxai/minimax-m2",type="completion"} 5`,
+		`proxypal_client_tokens_total{client="web",type="prompt"} 10`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q", line)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+)
+
+// adminAuth protects admin endpoints with the configured admin token, sent as
+// X-Admin-Token or as a bearer token. When no token is configured the
+// endpoints are disabled.
+func (ps *ProxyServer) adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := ps.Config().Server.AdminToken
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin endpoints are disabled without an admin token"})
+			return
+		}
+
+		provided := c.GetHeader("X-Admin-Token")
+		if provided == "" {
+			provided = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// statsAuth protects /stats and /metrics, which expose key usage and client
+// names, with the admin token once one is configured, unless
+// server.public_stats keeps them open
+func (ps *ProxyServer) statsAuth() gin.HandlerFunc {
+	admin := ps.adminAuth()
+	return func(c *gin.Context) {
+		if server := ps.Config().Server; server.PublicStats || server.AdminToken == "" {
+			c.Next()
+			return
+		}
+		admin(c)
+	}
+}
+
+// handleListDisabledKeys returns the keys quarantined after auth failures
+func (ps *ProxyServer) handleListDisabledKeys(c *gin.Context) {
+	st := ps.current()
+	count := 0
+	disabled := make(map[string][]balancer.DisabledKey, len(st.order))
+	for _, up := range st.order {
+		keys := up.loadBalancer.GetDisabledKeys()
+		disabled[up.name] = keys
+		count += len(keys)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"disabled": disabled,
+		"count":    count,
+	})
+}
+
+// handleEnableKey puts a quarantined key back into rotation. Without an
+// upstream in the path the key belongs to the default, first upstream.
+func (ps *ProxyServer) handleEnableKey(c *gin.Context) {
+	st := ps.current()
+	up, ok := st.order[0], true
+	if name := c.Param("upstream"); name != "" {
+		up, ok = st.upstream(name)
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown upstream"})
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key index"})
+		return
+	}
+
+	if err := up.loadBalancer.EnableKey(index); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"upstream": up.name, "enabled": index})
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// affinityKey identifies the conversation or client a chat completion belongs
+// to, using the first configured source the request has. It returns "" when
+// affinity is off or no source applies.
+func affinityKey(c *gin.Context, cfg config.AffinityConfig, reqBody map[string]interface{}) string {
+	for _, source := range cfg.By {
+		var value string
+		switch source {
+		case config.AffinityHeader:
+			if cfg.Header != "" {
+				value = c.GetHeader(cfg.Header)
+			}
+		case config.AffinityClient:
+			value = clientIdentity(c)
+		case config.AffinityMessages:
+			value = conversationHash(reqBody)
+		}
+		if value != "" {
+			return source + ":" + value
+		}
+	}
+	return ""
+}
+
+// clientIdentity returns the virtual client's name, or the key the caller
+// presented when virtual keys are not in use
+func clientIdentity(c *gin.Context) string {
+	if client := clientFromContext(c); client != nil {
+		return client.Name
+	}
+	key := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// conversationHash hashes the messages up to and including the first user
+// message, which stay the same on every turn of a conversation
+func conversationHash(reqBody map[string]interface{}) string {
+	messages, _ := reqBody["messages"].([]interface{})
+	leading := messages
+	for i, msg := range messages {
+		if m, ok := msg.(map[string]interface{}); ok && m["role"] == "user" {
+			leading = messages[:i+1]
+			break
+		}
+	}
+	if len(leading) == 0 {
+		return ""
+	}
+
+	data, err := json.Marshal(leading)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
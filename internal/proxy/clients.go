@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luongndcoder/proxypal-nvidia/internal/clients"
+)
+
+// clientContextKey is where the authenticated client is stored on the request
+const clientContextKey = "proxypal.client"
+
+// clientAuth requires a valid virtual API key when clients are configured
+func (ps *ProxyServer) clientAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		registry := ps.current().clients
+		if !registry.Enabled() {
+			c.Next()
+			return
+		}
+
+		key := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		client, err := registry.Authenticate(strings.TrimSpace(key))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": map[string]interface{}{
+					"message": err.Error(),
+					"type":    "invalid_request_error",
+					"code":    "invalid_api_key",
+				},
+			})
+			return
+		}
+
+		c.Set(clientContextKey, client)
+		c.Next()
+	}
+}
+
+// clientFromContext returns the authenticated client, or nil when virtual
+// keys are not in use
+func clientFromContext(c *gin.Context) *clients.Client {
+	if v, ok := c.Get(clientContextKey); ok {
+		return v.(*clients.Client)
+	}
+	return nil
+}
+
+// checkClientAccess enforces the client's model allow-list and budgets,
+// writing the error response and returning false when the request is refused
+func (ps *ProxyServer) checkClientAccess(c *gin.Context, model string) bool {
+	client := clientFromContext(c)
+	if client == nil {
+		return true
+	}
+
+	if !client.AllowsModel(model) {
+		client.Reject()
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": map[string]interface{}{
+				"message": "model " + model + " is not allowed for this API key",
+				"type":    "invalid_request_error",
+				"code":    "model_not_allowed",
+			},
+		})
+		return false
+	}
+
+	if err := client.Allow(); err != nil {
+		code := "rate_limit_exceeded"
+		if errors.Is(err, clients.ErrTokenBudgetExceeded) {
+			code = "insufficient_quota"
+		}
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": map[string]interface{}{
+				"message": err.Error(),
+				"type":    "rate_limit_error",
+				"code":    code,
+			},
+		})
+		return false
+	}
+
+	return true
+}
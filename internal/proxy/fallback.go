@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+)
+
+// servedModelHeader tells the client which model answered a chat completion
+const servedModelHeader = "X-ProxyPal-Served-Model"
+
+// dispatchResult describes the response chosen for a chat completion
+type dispatchResult struct {
+	resp     *http.Response
+	model    string // model that served the request
+	upstream *upstream
+	key      *balancer.APIKey
+	reserved int // tokens reserved on the key
+}
+
+// settleTokens replaces the tokens reserved for the request with those used
+func (r dispatchResult) settleTokens(used int) {
+	if r.key != nil {
+		r.upstream.loadBalancer.SettleTokens(r.key, r.reserved, used)
+	}
+}
+
+// dispatchWithFallback dispatches a chat completion for the requested model
+// and, while the model is overloaded or has no keys available, for each of
+// its configured fallbacks in turn. The result's upstream is set even when
+// an error is returned.
+func (ps *ProxyServer) dispatchWithFallback(c *gin.Context, st *serverState, reqBody map[string]interface{}, body []byte, model string, isStreaming bool) (dispatchResult, error) {
+	chain := fallbackChain(c, st, model)
+	tokens := estimateTokens(reqBody)
+
+	var (
+		result dispatchResult
+		err    error
+	)
+	for i, candidate := range chain {
+		result = dispatchResult{model: candidate, upstream: st.upstreamFor(candidate), reserved: tokens}
+		last := i == len(chain)-1
+
+		payload := body
+		if candidate != model {
+			reqBody["model"] = candidate
+			if payload, err = json.Marshal(reqBody); err != nil {
+				return result, err
+			}
+
+			ps.metrics.ObserveFallback(model, candidate)
+			if st.config.Logging.EnableRequestLog {
+				fmt.Printf("[%s] Falling back from model %s to %s\n",
+					time.Now().Format("2006-01-02 15:04:05"),
+					chain[i-1],
+					candidate)
+			}
+		}
+
+		// Only the last model in the chain waits for a key, the others give
+		// way to their fallback straight away
+		acquire := balancer.AcquireOptions{
+			Model:    candidate,
+			Tokens:   tokens,
+			Client:   identityFromContext(c),
+			Affinity: affinityKey(c, result.upstream.config.Affinity, reqBody),
+		}
+		result.resp, result.key, err = ps.dispatchChat(c, result.upstream, payload, candidate, acquire, isStreaming, last)
+		if last || !shouldFallback(result.resp, err) {
+			break
+		}
+		if result.resp != nil {
+			discardResponse(result.resp)
+			result.settleTokens(0)
+		}
+	}
+
+	return result, err
+}
+
+// fallbackChain returns the models to try for a request, leaving out
+// fallbacks the client is not allowed to use
+func fallbackChain(c *gin.Context, st *serverState, model string) []string {
+	client := clientFromContext(c)
+
+	chain := []string{model}
+	for _, fallback := range st.config.FallbackChain(model)[1:] {
+		if client == nil || client.AllowsModel(fallback) {
+			chain = append(chain, fallback)
+		}
+	}
+	return chain
+}
+
+// shouldFallback reports whether a dispatch outcome means the model is
+// overloaded or unavailable, so the next model in the chain should be tried
+func shouldFallback(resp *http.Response, err error) bool {
+	if err != nil {
+		// A client that went away has no use for a fallback
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	return resp.StatusCode == http.StatusServiceUnavailable ||
+		resp.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// identityContextKey is where the caller's identity is stored on the request
+const identityContextKey = "proxypal.identity"
+
+// clientIdleTimeout is how long a client's limits are kept after its last
+// request. By then its bucket has refilled, so forgetting it changes nothing.
+const clientIdleTimeout = 2 * time.Minute
+
+// clientLimiter enforces the requests per minute and concurrency of each
+// client, and the requests per minute of all clients together
+type clientLimiter struct {
+	global    *balancer.RateLimiter // nil without a global limit
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// clientBucket is what a single client is using
+type clientBucket struct {
+	limiter  *balancer.RateLimiter // nil without a requests per minute limit
+	inFlight int
+	lastSeen time.Time
+}
+
+// admission is the outcome of checking a request against the client limits
+type admission struct {
+	reason     string        // why the request was refused, empty when admitted
+	retryAfter time.Duration // when a refused request may be retried
+
+	limit     int // the client's requests per minute, 0 without a limit
+	remaining int
+}
+
+func newClientLimiter() *clientLimiter {
+	return &clientLimiter{
+		clients:   make(map[string]*clientBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// admit counts a request from the client against the limits. Admitted
+// requests must be finished with done.
+func (cl *clientLimiter) admit(identity string, cfg config.ClientLimitsConfig) admission {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	now := time.Now()
+	cl.sweepLocked(now)
+
+	b := cl.clients[identity]
+	if b == nil {
+		b = &clientBucket{}
+		cl.clients[identity] = b
+	}
+	b.lastSeen = now
+	b.limiter = configureLimiter(b.limiter, cfg.RequestsPerMinute)
+	cl.global = configureLimiter(cl.global, cfg.GlobalRequestsPerMinute)
+
+	result := admission{limit: cfg.RequestsPerMinute}
+
+	if cfg.MaxConcurrency > 0 && b.inFlight >= cfg.MaxConcurrency {
+		result.reason = "concurrency"
+		result.retryAfter = time.Second
+	} else if b.limiter != nil && b.limiter.AvailableTokens() == 0 {
+		result.reason = "rate"
+		result.retryAfter = b.limiter.TimeUntilNextToken()
+	} else if cl.global != nil && !cl.global.TryAcquire() {
+		result.reason = "global"
+		result.retryAfter = cl.global.TimeUntilNextToken()
+	} else {
+		if b.limiter != nil {
+			b.limiter.TryAcquire()
+		}
+		b.inFlight++
+	}
+
+	if b.limiter != nil {
+		result.remaining = b.limiter.AvailableTokens()
+	}
+	return result
+}
+
+// done finishes an admitted request
+func (cl *clientLimiter) done(identity string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if b := cl.clients[identity]; b != nil {
+		b.inFlight--
+		b.lastSeen = time.Now()
+	}
+}
+
+// sweepLocked forgets clients that have been idle for a while, at most once
+// per idle timeout. Must be called with the lock held.
+func (cl *clientLimiter) sweepLocked(now time.Time) {
+	if now.Sub(cl.lastSweep) < clientIdleTimeout {
+		return
+	}
+	cl.lastSweep = now
+
+	for identity, b := range cl.clients {
+		if b.inFlight == 0 && now.Sub(b.lastSeen) > clientIdleTimeout {
+			delete(cl.clients, identity)
+		}
+	}
+}
+
+// configureLimiter returns a limiter for the requests per minute, reusing rl
+// when there is one, or nil when the limit is 0
+func configureLimiter(rl *balancer.RateLimiter, limit int) *balancer.RateLimiter {
+	switch {
+	case limit == 0:
+		return nil
+	case rl == nil:
+		return balancer.NewRateLimiter(limit)
+	default:
+		rl.SetLimit(limit)
+		return rl
+	}
+}
+
+// clientLimits identifies the caller and enforces the client limits, adding
+// X-RateLimit-* headers when clients have a requests per minute limit
+func (ps *ProxyServer) clientLimits() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := ps.Config().ClientLimits
+		identity := callerIdentity(c, cfg)
+		c.Set(identityContextKey, identity)
+
+		result := ps.limits.admit(identity, cfg)
+		if result.limit > 0 {
+			reset := math.Ceil(float64(result.limit-result.remaining) * 60 / float64(result.limit))
+			c.Header("X-RateLimit-Limit", strconv.Itoa(result.limit))
+			c.Header("X-RateLimit-Remaining", strconv.Itoa(result.remaining))
+			c.Header("X-RateLimit-Reset", strconv.Itoa(int(reset)))
+		}
+
+		if result.reason != "" {
+			ps.metrics.ObserveClientThrottled(result.reason)
+
+			retryAfter := int(math.Ceil(result.retryAfter.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+
+			message := "client request rate limit exceeded"
+			switch result.reason {
+			case "concurrency":
+				message = "too many concurrent requests for this client"
+			case "global":
+				message = "proxy request rate limit exceeded"
+			}
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": map[string]interface{}{
+					"message": message,
+					"type":    "rate_limit_error",
+					"code":    "rate_limit_exceeded",
+				},
+			})
+			return
+		}
+
+		defer ps.limits.done(identity)
+		c.Next()
+	}
+}
+
+// callerIdentity identifies the client a request comes from, falling back to
+// its IP address when the configured identity is missing. Only virtual client
+// keys identify callers by key: any other key is unchecked, so a caller could
+// send a new one with every request to get a fresh budget.
+func callerIdentity(c *gin.Context, cfg config.ClientLimitsConfig) string {
+	switch cfg.By {
+	case config.ClientByIP:
+	case config.ClientByHeader:
+		if id := c.GetHeader(cfg.Header); id != "" {
+			return "header:" + id
+		}
+	default:
+		if client := clientFromContext(c); client != nil {
+			return "key:" + client.Name
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// identityFromContext returns the caller's identity, or "" outside the
+// client limits middleware
+func identityFromContext(c *gin.Context) string {
+	return c.GetString(identityContextKey)
+}
@@ -3,39 +3,178 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/luongndcoder/proxypal-nvidia/internal/clients"
 	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+	"github.com/luongndcoder/proxypal-nvidia/internal/metrics"
+	"github.com/luongndcoder/proxypal-nvidia/internal/state"
 )
 
-// ProxyServer handles incoming requests and proxies them to NVIDIA API
+// ProxyServer handles incoming requests and proxies them to the configured
+// upstream APIs
 type ProxyServer struct {
-	loadBalancer *balancer.LoadBalancer
-	config       *config.Config
-	httpClient   *http.Client
-}
-
-// NewProxyServer creates a new proxy server
-func NewProxyServer(cfg *config.Config, lb *balancer.LoadBalancer) *ProxyServer {
-	return &ProxyServer{
-		loadBalancer: lb,
-		config:       cfg,
-		httpClient: &http.Client{
-			Timeout: time.Duration(cfg.NVIDIA.Timeout) * time.Second,
-		},
+	state    atomic.Pointer[serverState]
+	metrics  *metrics.Metrics
+	reloadMu sync.Mutex
+
+	// Shutdown bookkeeping
+	draining atomic.Bool
+	inFlight atomic.Int64 // chat completions being served
+
+	cancelled atomic.Uint64 // chat completions abandoned by the client
+	usage     *usageTracker
+	labels    *modelLabels
+	limits    *clientLimiter
+
+	store  state.Store                 // nil when key state is not persisted
+	shared balancer.RateLimiterBackend // nil when rate limits are not shared
+}
+
+// errClientDisconnected means the client stopped reading a response
+var errClientDisconnected = errors.New("client disconnected")
+
+// serverState is everything derived from one version of the configuration.
+// It is swapped as a whole on reload, so a request sees a consistent view.
+type serverState struct {
+	config    *config.Config
+	upstreams map[string]*upstream
+	order     []*upstream // upstreams in config order
+	clients   *clients.Registry
+}
+
+// NewProxyServer creates a new proxy server with a load balancer per upstream
+func NewProxyServer(cfg *config.Config) *ProxyServer {
+	ps := &ProxyServer{
+		usage:  newUsageTracker(),
+		labels: newModelLabels(),
+		limits: newClientLimiter(),
+		store:  state.Open(cfg.State),
+		shared: openRateLimitStore(cfg.RateLimitStore),
+	}
+	ps.state.Store(ps.newServerState(cfg, nil, ps.loadState()))
+	ps.metrics = metrics.New(ps)
+
+	return ps
+}
+
+// newServerState builds the state for a configuration. Upstreams and clients
+// that already exist in prev are carried over with their state, and new
+// upstreams restore the key state saved for them.
+func (ps *ProxyServer) newServerState(cfg *config.Config, prev *serverState, saved map[string][]balancer.KeyState) *serverState {
+	st := &serverState{
+		config:    cfg,
+		upstreams: make(map[string]*upstream),
+	}
+
+	for _, upstreamCfg := range cfg.GetUpstreams() {
+		var up *upstream
+		if old, ok := prev.upstream(upstreamCfg.Name); ok {
+			up = old.reload(upstreamCfg)
+		} else {
+			up = newUpstream(upstreamCfg, saved[upstreamCfg.Name])
+			if ps.shared != nil {
+				up.loadBalancer.ShareRateLimits(ps.shared)
+			}
+		}
+		st.upstreams[up.name] = up
+		st.order = append(st.order, up)
+	}
+
+	if prev != nil {
+		st.clients = prev.clients.Reload(cfg.Clients)
+	} else {
+		st.clients = clients.NewRegistry(cfg.Clients)
+	}
+
+	return st
+}
+
+// openRateLimitStore returns the backend shared by replicas for key rate
+// limits, or nil when limits are kept in memory
+func openRateLimitStore(cfg config.RateLimitStoreConfig) balancer.RateLimiterBackend {
+	if cfg.Type != config.RateLimitStoreRedis {
+		return nil
 	}
+	return balancer.NewRedisBackend(cfg.Address, cfg.Password, cfg.DB, cfg.Prefix)
+}
+
+// upstream looks up an upstream by name, tolerating a nil state
+func (st *serverState) upstream(name string) (*upstream, bool) {
+	if st == nil {
+		return nil, false
+	}
+	up, ok := st.upstreams[name]
+	return up, ok
+}
+
+// upstreamFor returns the upstream that serves a model
+func (st *serverState) upstreamFor(model string) *upstream {
+	return st.upstreams[st.config.ResolveUpstream(model)]
+}
+
+// current returns the state for the active configuration
+func (ps *ProxyServer) current() *serverState {
+	return ps.state.Load()
+}
+
+// Config returns the active configuration
+func (ps *ProxyServer) Config() *config.Config {
+	return ps.current().config
+}
+
+// Reload validates a new configuration and swaps it in without dropping
+// requests in flight. Keys still configured keep their limiter state and
+// counters, new keys are added and removed keys are drained.
+func (ps *ProxyServer) Reload(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	ps.reloadMu.Lock()
+	defer ps.reloadMu.Unlock()
+
+	ps.state.Store(ps.newServerState(cfg, ps.current(), nil))
+	return nil
+}
+
+// StartDraining marks the server as shutting down so /health reports it as
+// not ready. Requests already in flight are served to completion.
+func (ps *ProxyServer) StartDraining() {
+	ps.draining.Store(true)
+}
+
+// InFlight returns the number of chat completions currently being served
+func (ps *ProxyServer) InFlight() int64 {
+	return ps.inFlight.Load()
+}
+
+// UpstreamStats returns key statistics for every upstream
+func (ps *ProxyServer) UpstreamStats() map[string][]balancer.KeyStats {
+	st := ps.current()
+	stats := make(map[string][]balancer.KeyStats, len(st.order))
+	for _, up := range st.order {
+		stats[up.name] = up.loadBalancer.GetStats()
+	}
+	return stats
 }
 
 // SetupRoutes configures the Gin router with proxy endpoints
 func (ps *ProxyServer) SetupRoutes(router *gin.Engine) {
 	// OpenAI-compatible endpoints
-	v1 := router.Group("/v1")
+	v1 := router.Group("/v1", ps.clientAuth(), ps.clientLimits())
 	{
 		v1.POST("/chat/completions", ps.handleChatCompletions)
 		v1.GET("/models", ps.handleListModels)
@@ -43,11 +182,25 @@ func (ps *ProxyServer) SetupRoutes(router *gin.Engine) {
 
 	// Health check and stats endpoints
 	router.GET("/health", ps.handleHealth)
-	router.GET("/stats", ps.handleStats)
+	router.GET("/stats", ps.statsAuth(), ps.handleStats)
+	router.GET("/metrics", ps.statsAuth(), gin.WrapH(ps.metrics.Handler()))
+
+	// Admin endpoints
+	admin := router.Group("/admin", ps.adminAuth())
+	{
+		admin.GET("/keys/disabled", ps.handleListDisabledKeys)
+		admin.POST("/upstreams/:upstream/keys/:index/enable", ps.handleEnableKey)
+		admin.POST("/keys/:index/enable", ps.handleEnableKey) // the default upstream
+	}
 }
 
-// handleChatCompletions proxies chat completion requests to NVIDIA API
+// handleChatCompletions proxies chat completion requests to the upstream
+// routed for the requested model
 func (ps *ProxyServer) handleChatCompletions(c *gin.Context) {
+	start := time.Now()
+	ps.inFlight.Add(1)
+	defer ps.inFlight.Add(-1)
+
 	// Read request body
 	bodyBytes, err := io.ReadAll(c.Request.Body)
 	if err != nil {
@@ -67,47 +220,131 @@ func (ps *ProxyServer) handleChatCompletions(c *gin.Context) {
 		isStreaming = stream
 	}
 
-	// Get API key from load balancer
-	apiKey, err := ps.loadBalancer.GetKeyWithRetry(ps.config.NVIDIA.Retry.MaxRetries)
-	if err != nil {
-		c.JSON(http.StatusTooManyRequests, gin.H{
-			"error": map[string]interface{}{
-				"message": err.Error(),
-				"type":    "rate_limit_error",
-				"code":    "rate_limit_exceeded",
-			},
-		})
+	model := "unknown"
+	if m, ok := reqBody["model"].(string); ok {
+		model = m
+	}
+
+	if !ps.checkClientAccess(c, model) {
 		return
 	}
 
-	// Log request if enabled
-	if ps.config.Logging.EnableRequestLog {
-		model := "unknown"
-		if m, ok := reqBody["model"].(string); ok {
-			model = m
+	defer func() {
+		ps.metrics.ObserveRequestDuration(isStreaming, time.Since(start))
+	}()
+
+	// Streams only report usage when asked to. Ask on the client's behalf and
+	// hide the usage from clients that did not ask for it themselves.
+	stripUsage := false
+	if isStreaming && requestStreamUsage(reqBody) {
+		if bodyBytes, err = json.Marshal(reqBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON request"})
+			return
 		}
-		fmt.Printf("[%s] Request to model: %s, streaming: %v, key: %s\n",
-			time.Now().Format("2006-01-02 15:04:05"),
-			model,
-			isStreaming,
-			balancer.MaskAPIKey(apiKey.Key))
+		stripUsage = true
 	}
 
-	// Create request to NVIDIA API
-	url := ps.config.NVIDIA.BaseURL + "/chat/completions"
-	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyBytes))
+	// Dispatch the request, failing over between keys and then between
+	// fallback models until a response is worth committing to
+	st := ps.current()
+	result, err := ps.dispatchWithFallback(c, st, reqBody, bodyBytes, model, isStreaming)
+	served := err == nil && result.model == model && result.resp.StatusCode < http.StatusBadRequest
+	ps.metrics.ObserveModelRequest(ps.labels.label(st.config, model, served))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
+		// Nobody is listening if the client gave up while we were waiting
+		if c.Request.Context().Err() != nil {
+			ps.recordCancellation(isStreaming)
+			c.Abort()
+			return
+		}
+		respondDispatchError(c, result.upstream, balancer.AcquireOptions{Model: result.model, Tokens: result.reserved}, err)
 		return
 	}
+	resp := result.resp
+	defer resp.Body.Close()
+
+	// Settle the reserved tokens once the response is done: with the usage
+	// upstream reported, nothing for an error, or the estimate when unknown
+	used := result.reserved
+	if resp.StatusCode >= http.StatusBadRequest {
+		used = 0
+	}
+	defer func() { result.settleTokens(used) }()
+
+	// Copy response headers
+	for key, values := range resp.Header {
+		for _, value := range values {
+			c.Header(key, value)
+		}
+	}
+	c.Header(servedModelHeader, result.model)
+
+	// Handle streaming response
+	if isStreaming {
+		usage, ok, err := ps.handleStreamingResponse(c, result.upstream, resp, stripUsage)
+		if ok {
+			ps.recordUsage(c, result, usage)
+			used = usage.TotalTokens
+		}
+		if err != nil {
+			ps.recordCancellation(isStreaming)
+		}
+		return
+	}
+
+	// Handle non-streaming response, keeping a copy to read usage from
+	var body bytes.Buffer
+	c.Status(resp.StatusCode)
+	if _, err := io.Copy(c.Writer, io.TeeReader(resp.Body, &body)); err != nil && c.Request.Context().Err() != nil {
+		ps.recordCancellation(isStreaming)
+		return
+	}
+
+	if usage, ok := parseUsage(body.Bytes()); ok {
+		ps.recordUsage(c, result, usage)
+		used = usage.TotalTokens
+	}
+}
+
+// recordCancellation counts a chat completion the client abandoned
+func (ps *ProxyServer) recordCancellation(isStreaming bool) {
+	ps.cancelled.Add(1)
+	ps.metrics.ObserveCancellation(isStreaming)
+}
+
+// recordUsage charges the tokens used by a request to the key, model and
+// client that served it
+func (ps *ProxyServer) recordUsage(c *gin.Context, result dispatchResult, usage Usage) {
+	result.upstream.loadBalancer.RecordUsage(result.key, usage.PromptTokens, usage.CompletionTokens)
+	model := ps.labels.label(ps.Config(), result.model, true)
+	ps.usage.record(model, usage)
+	ps.metrics.ObserveModelTokens(model, usage.PromptTokens, usage.CompletionTokens)
+
+	if client := clientFromContext(c); client != nil {
+		client.RecordUsage(usage.PromptTokens, usage.CompletionTokens)
+		ps.metrics.ObserveClientTokens(client.Name, usage.PromptTokens, usage.CompletionTokens)
+	}
+}
+
+// doChatRequest sends a chat completion request upstream with the given key
+func (ps *ProxyServer) doChatRequest(c *gin.Context, up *upstream, body []byte, apiKey *balancer.APIKey, isStreaming bool) (*http.Response, error) {
+	// Create request to the upstream API
+	// Tie the upstream request to the client so a disconnect stops generation
+	url := up.config.BaseURL + "/chat/completions"
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+apiKey.Key)
 
-	// Forward other headers from original request
+	// Forward other headers from original request. Accept-Encoding is left to
+	// the transport, which then decompresses the response so its usage can be
+	// read.
 	for key, values := range c.Request.Header {
-		if key != "Authorization" && key != "Host" {
+		if key != "Authorization" && key != "Host" && key != "Accept-Encoding" {
 			for _, value := range values {
 				req.Header.Add(key, value)
 			}
@@ -115,54 +352,73 @@ func (ps *ProxyServer) handleChatCompletions(c *gin.Context) {
 	}
 
 	// Execute request
-	resp, err := ps.httpClient.Do(req)
+	dispatched := time.Now()
+	resp, err := up.send(req, isStreaming)
 	if err != nil {
-		ps.loadBalancer.MarkKeyError(apiKey)
-		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to contact NVIDIA API"})
-		return
-	}
-	defer resp.Body.Close()
-
-	// Handle rate limit errors
-	if resp.StatusCode == http.StatusTooManyRequests {
-		ps.loadBalancer.MarkKeyError(apiKey)
-
-		// Try with a different key if auto-failover is enabled
-		if ps.config.NVIDIA.Retry.AutoFailover {
-			newKey, err := ps.loadBalancer.GetKeyWithRetry(ps.config.NVIDIA.Retry.MaxRetries)
-			if err == nil {
-				// Retry with new key
-				req.Header.Set("Authorization", "Bearer "+newKey.Key)
-				resp, err = ps.httpClient.Do(req)
-				if err != nil {
-					c.JSON(http.StatusBadGateway, gin.H{"error": "failed to contact NVIDIA API"})
-					return
-				}
-				defer resp.Body.Close()
-			}
+		if errors.Is(err, errFirstByteTimeout) {
+			ps.metrics.ObserveUpstreamTimeout(up.name, "first_byte")
 		}
+		return nil, err
 	}
+	ttfb := time.Since(dispatched)
+	ps.metrics.ObserveTimeToFirstByte(up.name, isStreaming, ttfb)
+	up.loadBalancer.ObserveTTFB(apiKey, ttfb)
+	ps.metrics.ObserveUpstreamStatus(up.name, resp.StatusCode)
+	up.loadBalancer.ApplyUpstreamLimits(apiKey, balancer.ParseUpstreamLimits(resp.Header, time.Now()))
 
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			c.Header(key, value)
-		}
+	return resp, nil
+}
+
+// respondDispatchError reports a request that could not be served by an
+// upstream. The options are those keys were acquired with.
+func respondDispatchError(c *gin.Context, up *upstream, opts balancer.AcquireOptions, err error) {
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to contact upstream API " + up.name})
+		return
 	}
+	if errors.Is(err, balancer.ErrModelNotServed) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": map[string]interface{}{
+				"message": err.Error(),
+				"type":    "invalid_request_error",
+				"code":    "model_not_found",
+			},
+		})
+		return
+	}
+	respondNoKey(c, up, opts, err)
+}
 
-	// Handle streaming response
-	if isStreaming {
-		ps.handleStreamingResponse(c, resp)
+// respondNoKey reports that no API key could be acquired for the request,
+// telling the client when to come back
+func respondNoKey(c *gin.Context, up *upstream, opts balancer.AcquireOptions, err error) {
+	// Nobody is listening if the client gave up while queued
+	if errors.Is(err, context.Canceled) {
+		c.Abort()
 		return
 	}
 
-	// Handle non-streaming response
-	c.Status(resp.StatusCode)
-	io.Copy(c.Writer, resp.Body)
+	retryAfter := int(math.Ceil(up.loadBalancer.NextAvailableIn(opts).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": map[string]interface{}{
+			"message": err.Error(),
+			"type":    "rate_limit_error",
+			"code":    "rate_limit_exceeded",
+		},
+	})
 }
 
-// handleStreamingResponse handles server-sent events streaming
-func (ps *ProxyServer) handleStreamingResponse(c *gin.Context, resp *http.Response) {
+// handleStreamingResponse handles server-sent events streaming and returns
+// the token usage if the upstream reported it. It stops as soon as the client
+// disconnects, returning errClientDisconnected, so the upstream request is
+// abandoned instead of generating tokens nobody reads.
+func (ps *ProxyServer) handleStreamingResponse(c *gin.Context, up *upstream, resp *http.Response, hideUsage bool) (Usage, bool, error) {
 	c.Status(resp.StatusCode)
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -172,56 +428,167 @@ func (ps *ProxyServer) handleStreamingResponse(c *gin.Context, resp *http.Respon
 	c.Writer.Flush()
 
 	// Stream the response
+	ctx := c.Request.Context()
+	var usage Usage
+	var hasUsage bool
+	skipBlank := false // drop the separator after a dropped event
 	reader := bufio.NewReader(resp.Body)
 	for {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
+			if ctx.Err() != nil {
+				return usage, hasUsage, errClientDisconnected
+			}
+			if errors.Is(err, errIdleTimeout) {
+				ps.metrics.ObserveUpstreamTimeout(up.name, "idle")
+			}
 			if err != io.EOF {
-				fmt.Printf("Error reading stream: %v\n", err)
+				fmt.Printf("Error reading stream from %s: %v\n", up.name, err)
 			}
 			break
 		}
 
+		if skipBlank {
+			skipBlank = false
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+		}
+
+		if data, ok := sseData(line); ok {
+			if u, ok := parseUsage(data); ok {
+				usage, hasUsage = u, true
+			}
+			if hideUsage {
+				chunk, keep := stripUsage(data)
+				if !keep {
+					skipBlank = true
+					continue
+				}
+				if !bytes.Equal(chunk, data) {
+					line = append(append([]byte("data: "), chunk...), '\n')
+				}
+			}
+		}
+
 		// Write line to client
-		c.Writer.Write(line)
+		if _, err := c.Writer.Write(line); err != nil {
+			return usage, hasUsage, errClientDisconnected
+		}
 		c.Writer.Flush()
+
+		if ctx.Err() != nil {
+			return usage, hasUsage, errClientDisconnected
+		}
 	}
+
+	return usage, hasUsage, nil
 }
 
-// handleListModels returns available models
+// handleListModels returns available models. With several upstreams their
+// model lists are merged.
 func (ps *ProxyServer) handleListModels(c *gin.Context) {
-	// Get API key
-	apiKey, err := ps.loadBalancer.GetNextKey()
-	if err != nil {
-		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
-		return
-	}
+	st := ps.current()
+	if len(st.order) == 1 {
+		up := st.order[0]
+		resp, err := ps.fetchModels(c, up)
+		if err != nil {
+			respondDispatchError(c, up, balancer.AcquireOptions{}, err)
+			return
+		}
+		defer resp.Body.Close()
 
-	// Create request to NVIDIA API
-	url := ps.config.NVIDIA.BaseURL + "/models"
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
+		// Forward response
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, resp.Body)
 		return
 	}
 
-	req.Header.Set("Authorization", "Bearer "+apiKey.Key)
+	models := make([]json.RawMessage, 0)
+	for _, up := range st.order {
+		resp, err := ps.fetchModels(c, up)
+		if err != nil {
+			fmt.Printf("Error listing models from %s: %v\n", up.name, err)
+			continue
+		}
 
-	// Execute request
-	resp, err := ps.httpClient.Do(req)
-	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to contact NVIDIA API"})
-		return
+		var list struct {
+			Data []json.RawMessage `json:"data"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+				fmt.Printf("Error decoding models from %s: %v\n", up.name, err)
+			}
+		}
+		resp.Body.Close()
+
+		models = append(models, list.Data...)
 	}
-	defer resp.Body.Close()
 
-	// Forward response
-	c.Status(resp.StatusCode)
-	io.Copy(c.Writer, resp.Body)
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   models,
+	})
+}
+
+// fetchModels requests the model list from an upstream, retrying with
+// another key when one is rejected
+func (ps *ProxyServer) fetchModels(c *gin.Context, up *upstream) (*http.Response, error) {
+	var tried []*balancer.APIKey
+	for {
+		// Get API key
+		apiKey, err := up.loadBalancer.Acquire(c.Request.Context(), balancer.AcquireOptions{Exclude: tried})
+		if err != nil {
+			return nil, err
+		}
+		tried = append(tried, apiKey)
+
+		// Create request to the upstream API
+		url := up.config.BaseURL + "/models"
+		req, err := http.NewRequestWithContext(c.Request.Context(), "GET", url, nil)
+		if err != nil {
+			up.loadBalancer.Release(apiKey)
+			return nil, &upstreamError{err: err}
+		}
+
+		req.Header.Set("Authorization", "Bearer "+apiKey.Key)
+
+		// Execute request
+		resp, err := up.send(req, false)
+		if err != nil {
+			up.loadBalancer.MarkKeyError(apiKey)
+			up.loadBalancer.Release(apiKey)
+			return nil, &upstreamError{err: err}
+		}
+		up.holdKey(resp, apiKey)
+		up.loadBalancer.ApplyUpstreamLimits(apiKey, balancer.ParseUpstreamLimits(resp.Header, time.Now()))
+
+		if !up.rejectedKey(apiKey, resp.StatusCode, "") {
+			up.recordKeyOutcome(apiKey, resp.StatusCode)
+			return resp, nil
+		}
+
+		// Retry rejected keys with another one while any is left
+		up.quarantineKey(apiKey, resp.StatusCode)
+		if !up.loadBalancer.CanFailover(tried, "") {
+			return resp, nil
+		}
+		discardResponse(resp)
+	}
 }
 
 // handleHealth returns health status
 func (ps *ProxyServer) handleHealth(c *gin.Context) {
+	// Tell load balancers to stop sending traffic while we drain
+	if ps.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":    "draining",
+			"in_flight": ps.InFlight(),
+			"time":      time.Now().Format(time.RFC3339),
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"status": "healthy",
 		"time":   time.Now().Format(time.RFC3339),
@@ -230,11 +597,37 @@ func (ps *ProxyServer) handleHealth(c *gin.Context) {
 
 // handleStats returns load balancer statistics
 func (ps *ProxyServer) handleStats(c *gin.Context) {
-	stats := ps.loadBalancer.GetStats()
+	st := ps.current()
+	totalKeys := 0
+	upstreams := gin.H{}
+	var defaultStats []balancer.KeyStats // kept at the top level, as before upstreams
+	for i, up := range st.order {
+		stats := up.loadBalancer.GetStats()
+		totalKeys += len(stats)
+		if i == 0 {
+			defaultStats = stats
+		}
 
-	c.JSON(http.StatusOK, gin.H{
-		"keys":      len(stats),
-		"stats":     stats,
+		upstreams[up.name] = gin.H{
+			"base_url": up.config.BaseURL,
+			"keys":     len(stats),
+			"queued":   up.loadBalancer.QueueLength(),
+			"draining": up.loadBalancer.DrainingCount(),
+			"stats":    stats,
+		}
+	}
+
+	response := gin.H{
+		"keys":      totalKeys,
+		"stats":     defaultStats,
+		"upstreams": upstreams,
+		"models":    ps.usage.stats(),
+		"cancelled": ps.cancelled.Load(),
 		"timestamp": time.Now().Format(time.RFC3339),
-	})
+	}
+	if st.clients.Enabled() {
+		response["clients"] = st.clients.GetStats()
+	}
+
+	c.JSON(http.StatusOK, response)
 }
@@ -0,0 +1,1322 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestServer creates a proxy in front of the given upstream handler
+func newTestServer(t *testing.T, upstream http.HandlerFunc, keys ...string) (*gin.Engine, *balancer.LoadBalancer) {
+	t.Helper()
+
+	backend := httptest.NewServer(upstream)
+	t.Cleanup(backend.Close)
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{Port: 8080, AdminToken: testAdminToken},
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 40,
+			APIKeys:   keys,
+			Timeout:   5,
+			Retry: config.RetryConfig{
+				MaxRetries:   3,
+				AutoFailover: true,
+			},
+		},
+	}
+
+	ps := NewProxyServer(cfg)
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	return router, ps.current().upstreams["nvidia"].loadBalancer
+}
+
+func serve(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+// testAdminToken is the admin token of servers from newTestServer
+const testAdminToken = "test-admin-token"
+
+// serveAdmin sends a request with the test admin token
+func serveAdmin(router *gin.Engine, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("X-Admin-Token", testAdminToken)
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestChatCompletions_QuarantinesRejectedKey(t *testing.T) {
+	router, lb := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer nvapi-revoked-key-0001" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":"ok"}`))
+	}, "nvapi-revoked-key-0001", "nvapi-working-key-0002")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m","messages":[]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected transparent retry to succeed, got %d", rec.Code)
+	}
+	if rec.Body.String() != `{"id":"ok"}` {
+		t.Errorf("Unexpected body: %s", rec.Body.String())
+	}
+
+	disabled := lb.GetDisabledKeys()
+	if len(disabled) != 1 || disabled[0].Index != 0 {
+		t.Fatalf("Expected the revoked key to be disabled, got %+v", disabled)
+	}
+
+	// Re-enable through the admin endpoint
+	rec = serve(router, "POST", "/admin/upstreams/nvidia/keys/0/enable", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without the admin token, got %d", rec.Code)
+	}
+	rec = serveAdmin(router, "POST", "/admin/upstreams/nvidia/keys/0/enable")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected key to be re-enabled, got %d", rec.Code)
+	}
+	if len(lb.GetDisabledKeys()) != 0 {
+		t.Error("Expected no disabled keys after re-enabling")
+	}
+
+	// The route without an upstream still works for the default upstream
+	key, _ := lb.GetNextKey()
+	lb.DisableKey(key, "test")
+	rec = serveAdmin(router, "POST", "/admin/keys/0/enable")
+	if rec.Code != http.StatusOK || len(lb.GetDisabledKeys()) != 0 {
+		t.Errorf("Expected the default upstream route to re-enable the key, got %d", rec.Code)
+	}
+}
+
+func TestChatCompletions_QuarantinesRejectedKeyWithoutFailover(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer nvapi-revoked-key-0001" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":"ok"}`))
+	}))
+	defer backend.Close()
+
+	// Without auto_failover a rejected key still hands the request on
+	ps := NewProxyServer(&config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 40,
+			APIKeys:   []string{"nvapi-revoked-key-0001", "nvapi-working-key-0002"},
+			Timeout:   5,
+		},
+	})
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m","messages":[]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the request to move to the working key, got %d", rec.Code)
+	}
+	if disabled := ps.current().upstreams["nvidia"].loadBalancer.GetDisabledKeys(); len(disabled) != 1 {
+		t.Errorf("Expected the revoked key to be disabled, got %+v", disabled)
+	}
+}
+
+func TestChatCompletions_ForbiddenModel(t *testing.T) {
+	router, lb := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer nvapi-revoked-key-0001" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"choices":[]}`))
+	}, "nvapi-revoked-key-0001", "nvapi-working-key-0002")
+
+	// A 403 fails over to the other key without giving up on the first yet
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m1","messages":[]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the request to fail over, got %d", rec.Code)
+	}
+	if disabled := lb.GetDisabledKeys(); len(disabled) != 0 {
+		t.Fatalf("Expected no key to be disabled after one 403, got %+v", disabled)
+	}
+
+	// Refused again and again, even for the same model, the key is rejected
+	for i := 0; i < 2; i++ {
+		if rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m1","messages":[]}`); rec.Code != http.StatusOK {
+			t.Fatalf("Expected the request to fail over, got %d", rec.Code)
+		}
+	}
+	disabled := lb.GetDisabledKeys()
+	if len(disabled) != 1 || disabled[0].Index != 0 {
+		t.Errorf("Expected the refused key to be disabled, got %+v", disabled)
+	}
+}
+
+func TestChatCompletions_ForbiddenByAllKeys(t *testing.T) {
+	router, lb := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}, "nvapi-limited-key-0001", "nvapi-limited-key-0002")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m1","messages":[]}`)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected the last 403 to be forwarded, got %d", rec.Code)
+	}
+	if disabled := lb.GetDisabledKeys(); len(disabled) != 0 {
+		t.Errorf("Expected no key to be disabled after one 403 each, got %+v", disabled)
+	}
+}
+
+func TestAdmin_DisabledWithoutToken(t *testing.T) {
+	cfg := &config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   "http://127.0.0.1:1",
+			RateLimit: 40,
+			APIKeys:   []string{"nvapi-key-0001"},
+		},
+	}
+	ps := NewProxyServer(cfg)
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	lb := ps.current().upstreams["nvidia"].loadBalancer
+	key, err := lb.GetNextKey()
+	if err != nil {
+		t.Fatalf("Failed to get key: %v", err)
+	}
+	lb.DisableKey(key, "test")
+
+	rec := serve(router, "POST", "/admin/upstreams/nvidia/keys/0/enable", "")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 without an admin token configured, got %d", rec.Code)
+	}
+	if len(lb.GetDisabledKeys()) != 1 {
+		t.Error("Expected the key to stay disabled")
+	}
+
+	// Stats stay open until an admin token is set
+	for _, path := range []string{"/stats", "/metrics"} {
+		if rec := serve(router, "GET", path, ""); rec.Code != http.StatusOK {
+			t.Errorf("Expected %s to be open without an admin token, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestStats_DefaultUpstreamAtTopLevel(t *testing.T) {
+	router, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {}, "nvapi-key-0001", "nvapi-key-0002")
+
+	var response struct {
+		Stats     []balancer.KeyStats `json:"stats"`
+		Upstreams map[string]struct {
+			Stats []balancer.KeyStats `json:"stats"`
+		} `json:"upstreams"`
+	}
+	if err := json.Unmarshal(serveAdmin(router, "GET", "/stats").Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if len(response.Stats) != 2 || len(response.Upstreams["nvidia"].Stats) != 2 {
+		t.Errorf("Expected the default upstream's keys at the top level too, got %+v", response)
+	}
+}
+
+func TestStats_RequiresAdminToken(t *testing.T) {
+	router, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {}, "nvapi-key-0001")
+
+	for _, path := range []string{"/stats", "/metrics"} {
+		if rec := serve(router, "GET", path, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for %s without a token, got %d", path, rec.Code)
+		}
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Expected 200 for %s with a bearer token, got %d", path, rec.Code)
+		}
+	}
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{AdminToken: testAdminToken, PublicStats: true},
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   "http://127.0.0.1:1",
+			RateLimit: 40,
+			APIKeys:   []string{"nvapi-key-0001"},
+		},
+	}
+	ps := NewProxyServer(cfg)
+	public := gin.New()
+	ps.SetupRoutes(public)
+
+	if rec := serve(public, "GET", "/stats", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with public_stats, got %d", rec.Code)
+	}
+}
+
+func TestListModels_QuarantinesRejectedKey(t *testing.T) {
+	router, lb := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer nvapi-revoked-key-0001" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data":[]}`))
+	}, "nvapi-revoked-key-0001", "nvapi-working-key-0002")
+
+	rec := serve(router, "GET", "/v1/models", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected transparent retry to succeed, got %d", rec.Code)
+	}
+	if len(lb.GetDisabledKeys()) != 1 {
+		t.Error("Expected the revoked key to be disabled")
+	}
+}
+
+func TestChatCompletions_FailsOverOnServerError(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	router, lb := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+
+		if r.Header.Get("Authorization") == "Bearer nvapi-failing-key-0001" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":"overloaded"}`))
+			return
+		}
+		w.Write([]byte(`{"id":"ok"}`))
+	}, "nvapi-failing-key-0001", "nvapi-working-key-0002")
+
+	request := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	rec := serve(router, "POST", "/v1/chat/completions", request)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected failover to succeed, got %d", rec.Code)
+	}
+	if rec.Body.String() != `{"id":"ok"}` {
+		t.Errorf("Expected only the successful response to reach the client, got %s", rec.Body.String())
+	}
+
+	// Each attempt must carry the full request body
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 {
+		t.Fatalf("Expected 2 upstream attempts, got %d", len(bodies))
+	}
+	for i, body := range bodies {
+		if body != request {
+			t.Errorf("Attempt %d sent body %q, expected %q", i+1, body, request)
+		}
+	}
+
+	if errors := lb.GetStats()[0].ErrorCount; errors != 1 {
+		t.Errorf("Expected failing key to record 1 error, got %d", errors)
+	}
+}
+
+func TestChatCompletions_FailsOverOnConnectionError(t *testing.T) {
+	router, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer nvapi-broken-key-0001" {
+			// Drop the connection without a response
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"id":"ok"}`))
+	}, "nvapi-broken-key-0001", "nvapi-working-key-0002")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected failover to succeed, got %d", rec.Code)
+	}
+}
+
+func TestChatCompletions_ForwardsLastFailure(t *testing.T) {
+	var calls atomic.Int32
+	router, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":"slow down"}`))
+	}, "nvapi-limited-key-0001", "nvapi-limited-key-0002", "nvapi-limited-key-0003", "nvapi-limited-key-0004")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected last upstream failure to be forwarded, got %d", rec.Code)
+	}
+	if rec.Body.String() != `{"error":"slow down"}` {
+		t.Errorf("Unexpected body: %s", rec.Body.String())
+	}
+
+	// max_retries is 3 in the test config
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 attempts with distinct keys, got %d", calls.Load())
+	}
+}
+
+func TestChatCompletions_NoRetryWithoutOtherKeys(t *testing.T) {
+	var calls atomic.Int32
+	router, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}, "nvapi-only-key-0001")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m"}`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected upstream failure to be forwarded, got %d", rec.Code)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected a single attempt, got %d", calls.Load())
+	}
+}
+
+func TestChatCompletions_RetryDoesNotQueue(t *testing.T) {
+	var calls atomic.Int32
+	router, lb := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, "nvapi-working-key-0001", "nvapi-limited-key-0002")
+
+	for i := 0; i < 2; i++ {
+		key, err := lb.GetNextKey()
+		if err != nil {
+			t.Fatalf("Failed to get key: %v", err)
+		}
+		lb.Release(key)
+		if key.Key == "nvapi-limited-key-0002" {
+			key.RateLimiter.PauseUntil(time.Now().Add(time.Minute))
+		}
+	}
+
+	// The other key is out of requests, so the 503 is forwarded rather than
+	// waiting for it
+	start := time.Now()
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m"}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the upstream failure to be forwarded, got %d", rec.Code)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected a single attempt, got %d", calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the retry not to queue, took %v", elapsed)
+	}
+}
+
+func TestChatCompletions_NoRetryOnClientError(t *testing.T) {
+	var calls atomic.Int32
+	router, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}, "nvapi-working-key-0001", "nvapi-working-key-0002")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected client error to be forwarded, got %d", rec.Code)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected a single attempt, got %d", calls.Load())
+	}
+}
+
+func TestChatCompletions_ClientKeys(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer nvapi-upstream-key-0001" {
+			t.Errorf("Virtual key must not be forwarded upstream, got %q", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"id":"ok","usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 40,
+			APIKeys:   []string{"nvapi-upstream-key-0001"},
+			Timeout:   5,
+		},
+		Clients: []config.ClientConfig{
+			{Name: "web", Key: "sk-web", AllowedModels: []string{"m"}},
+		},
+	}
+
+	proxyServer := NewProxyServer(cfg)
+	router := gin.New()
+	proxyServer.SetupRoutes(router)
+
+	send := func(auth, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("", `{"model":"m"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a key, got %d", rec.Code)
+	}
+	if rec := send("Bearer sk-wrong", `{"model":"m"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with an unknown key, got %d", rec.Code)
+	}
+	if rec := send("Bearer sk-web", `{"model":"other"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a model outside the allow-list, got %d", rec.Code)
+	}
+	if rec := send("Bearer sk-web", `{"model":"m"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with a valid key, got %d", rec.Code)
+	}
+
+	stats := proxyServer.current().clients.GetStats()
+	if stats[0].RequestCount != 1 || stats[0].TotalTokens != 15 {
+		t.Errorf("Unexpected client stats: %+v", stats[0])
+	}
+}
+
+func TestChatCompletions_RoutesByModel(t *testing.T) {
+	newBackend := func(name string, models ...string) *httptest.Server {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/models" {
+				var data []string
+				for _, model := range models {
+					data = append(data, `{"id":"`+model+`"}`)
+				}
+				w.Write([]byte(`{"object":"list","data":[` + strings.Join(data, ",") + `]}`))
+				return
+			}
+			w.Write([]byte(`{"served_by":"` + name + `"}`))
+		}))
+		t.Cleanup(backend.Close)
+		return backend
+	}
+	nvidia := newBackend("nvidia", "meta/llama-3.1-8b-instruct")
+	local := newBackend("local", "qwen2.5-coder")
+
+	cfg := &config.Config{
+		Upstreams: []config.UpstreamConfig{
+			{Name: "nvidia", BaseURL: nvidia.URL, RateLimit: 40, APIKeys: []string{"nvapi-key-0001"}, Timeout: 5},
+			{Name: "local", BaseURL: local.URL, RateLimit: 40, APIKeys: []string{"EMPTY"}, Timeout: 5},
+		},
+		Routes: []config.RouteConfig{
+			{Match: config.MatchPrefix, Pattern: "qwen", Upstream: "local"},
+		},
+	}
+	router := gin.New()
+	NewProxyServer(cfg).SetupRoutes(router)
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"qwen2.5-coder", "local"},
+		{"meta/llama-3.1-8b-instruct", "nvidia"},
+		{"unrouted-model", "nvidia"},
+	}
+	for _, tt := range tests {
+		rec := serve(router, "POST", "/v1/chat/completions", `{"model":"`+tt.model+`"}`)
+		if want := `{"served_by":"` + tt.want + `"}`; rec.Body.String() != want {
+			t.Errorf("Model %s: expected %s, got %s", tt.model, want, rec.Body.String())
+		}
+	}
+
+	rec := serve(router, "GET", "/v1/models", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 listing models, got %d", rec.Code)
+	}
+	for _, model := range []string{"meta/llama-3.1-8b-instruct", "qwen2.5-coder"} {
+		if !strings.Contains(rec.Body.String(), model) {
+			t.Errorf("Expected merged model list to contain %s, got %s", model, rec.Body.String())
+		}
+	}
+}
+
+func TestChatCompletions_FallsBackToNextModel(t *testing.T) {
+	var models []string
+	var mu sync.Mutex
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		mu.Lock()
+		models = append(models, req.Model)
+		mu.Unlock()
+
+		if req.Model == "minimaxai/minimax-m2" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"model\":\"" + req.Model + "\"}\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Write([]byte(`{"model":"` + req.Model + `"}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 40,
+			APIKeys:   []string{"nvapi-upstream-key-0001"},
+			Timeout:   5,
+		},
+		Fallbacks: config.FallbackConfig{
+			"minimaxai/minimax-m2": {"meta/llama-3.1-8b-instruct"},
+		},
+	}
+	router := gin.New()
+	NewProxyServer(cfg).SetupRoutes(router)
+
+	for _, stream := range []bool{false, true} {
+		mu.Lock()
+		models = nil
+		mu.Unlock()
+
+		body := `{"model":"minimaxai/minimax-m2","stream":` + strconv.FormatBool(stream) + `}`
+		rec := serve(router, "POST", "/v1/chat/completions", body)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("stream=%v: expected fallback to succeed, got %d", stream, rec.Code)
+		}
+		if served := rec.Header().Get(servedModelHeader); served != "meta/llama-3.1-8b-instruct" {
+			t.Errorf("stream=%v: expected served model header for the fallback, got %q", stream, served)
+		}
+		if !strings.Contains(rec.Body.String(), `"model":"meta/llama-3.1-8b-instruct"`) {
+			t.Errorf("stream=%v: unexpected body: %s", stream, rec.Body.String())
+		}
+		mu.Lock()
+		if len(models) != 2 || models[1] != "meta/llama-3.1-8b-instruct" {
+			t.Errorf("stream=%v: expected the fallback model to be requested second, got %v", stream, models)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestChatCompletions_FallsBackWhenKeysExhausted(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"ok"}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Upstreams: []config.UpstreamConfig{
+			{Name: "busy", BaseURL: backend.URL, RateLimit: 40, APIKeys: []string{"nvapi-busy-key-0001"}, Timeout: 5},
+			{Name: "spare", BaseURL: backend.URL, RateLimit: 40, APIKeys: []string{"nvapi-spare-key-0001"}, Timeout: 5},
+		},
+		Routes: []config.RouteConfig{
+			{Pattern: "small-model", Upstream: "spare"},
+		},
+		Fallbacks: config.FallbackConfig{
+			"big-model": {"small-model"},
+		},
+	}
+	ps := NewProxyServer(cfg)
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	busy := ps.current().upstreams["busy"].loadBalancer
+	key, err := busy.GetNextKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy.DisableKey(key, "test")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"big-model"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected fallback to succeed, got %d", rec.Code)
+	}
+	if served := rec.Header().Get(servedModelHeader); served != "small-model" {
+		t.Errorf("Expected small-model to serve the request, got %q", served)
+	}
+}
+
+func TestReload_DrainsRemovedKeyMidStream(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	var mu sync.Mutex
+	var auths []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auths = append(auths, r.Header.Get("Authorization"))
+		mu.Unlock()
+
+		if r.Header.Get("Authorization") == "Bearer nvapi-old-key-0001" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"n\":1}\n\n"))
+			w.(http.Flusher).Flush()
+			close(started)
+			<-finish
+			w.Write([]byte("data: [DONE]\n\n"))
+			return
+		}
+		w.Write([]byte(`{"id":"ok"}`))
+	}))
+	defer backend.Close()
+
+	newConfig := func(key string) *config.Config {
+		return &config.Config{
+			Server: config.ServerConfig{Port: 8080},
+			NVIDIA: config.NVIDIAConfig{
+				BaseURL:   backend.URL,
+				RateLimit: 40,
+				APIKeys:   []string{key},
+				Timeout:   5,
+			},
+		}
+	}
+
+	ps := NewProxyServer(newConfig("nvapi-old-key-0001"))
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	streamed := make(chan *httptest.ResponseRecorder)
+	go func() {
+		streamed <- serve(router, "POST", "/v1/chat/completions", `{"model":"m","stream":true}`)
+	}()
+	<-started
+
+	if err := ps.Reload(newConfig("nvapi-new-key-0002")); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	lb := ps.current().upstreams["nvidia"].loadBalancer
+	if lb.DrainingCount() != 1 {
+		t.Errorf("Expected the old key to be draining, got %d", lb.DrainingCount())
+	}
+
+	// New requests use the new key while the stream is still running
+	if rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 after reload, got %d", rec.Code)
+	}
+	mu.Lock()
+	if last := auths[len(auths)-1]; last != "Bearer nvapi-new-key-0002" {
+		t.Errorf("Expected the new key to be used, got %s", last)
+	}
+	mu.Unlock()
+
+	close(finish)
+	rec := <-streamed
+	if !strings.Contains(rec.Body.String(), "[DONE]") {
+		t.Errorf("Expected the stream to complete, got %q", rec.Body.String())
+	}
+	if lb.DrainingCount() != 0 {
+		t.Errorf("Expected the old key to be dropped once drained, got %d", lb.DrainingCount())
+	}
+}
+
+func TestReload_RejectsInvalidConfig(t *testing.T) {
+	ps := NewProxyServer(&config.Config{
+		Server: config.ServerConfig{Port: 8080},
+		NVIDIA: config.NVIDIAConfig{BaseURL: "http://localhost", RateLimit: 40, APIKeys: []string{"nvapi-key-0001"}},
+	})
+
+	invalid := &config.Config{Server: config.ServerConfig{Port: 8080}}
+	if err := ps.Reload(invalid); err == nil {
+		t.Fatal("Expected an invalid configuration to be rejected")
+	}
+	if ps.Config().NVIDIA.BaseURL != "http://localhost" {
+		t.Error("Expected the current configuration to be kept")
+	}
+}
+
+func TestHealth_ReportsDraining(t *testing.T) {
+	ps := NewProxyServer(&config.Config{
+		Server: config.ServerConfig{Port: 8080},
+		NVIDIA: config.NVIDIAConfig{BaseURL: "http://localhost", RateLimit: 40, APIKeys: []string{"nvapi-key-0001"}},
+	})
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	if rec := serve(router, "GET", "/health", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected healthy before shutdown, got %d", rec.Code)
+	}
+
+	ps.StartDraining()
+
+	rec := serve(router, "GET", "/health", "")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while draining, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"status":"draining"`) {
+		t.Errorf("Unexpected body: %s", rec.Body.String())
+	}
+}
+
+func TestChatCompletions_ClientDisconnectCancelsUpstream(t *testing.T) {
+	upstreamGone := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				close(upstreamGone)
+				return
+			case <-ticker.C:
+				w.Write([]byte("data: {\"choices\":[]}\n\n"))
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer backend.Close()
+
+	ps := NewProxyServer(&config.Config{
+		Server: config.ServerConfig{Port: 8080},
+		NVIDIA: config.NVIDIAConfig{BaseURL: backend.URL, RateLimit: 40, APIKeys: []string{"nvapi-key-0001"}, Timeout: 5},
+	})
+	router := gin.New()
+	ps.SetupRoutes(router)
+	proxy := httptest.NewServer(router)
+	defer proxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "POST", proxy.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model":"m","stream":true}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the first chunk, then hang up
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-upstreamGone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the upstream request to be cancelled")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for ps.cancelled.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 1 cancellation, got %d", ps.cancelled.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if errors := ps.current().upstreams["nvidia"].loadBalancer.GetStats()[0].ErrorCount; errors != 0 {
+		t.Errorf("Expected a client disconnect not to count against the key, got %d errors", errors)
+	}
+}
+
+// newTimeoutTestServer creates a proxy with one-second stream timeouts
+func newTimeoutTestServer(t *testing.T, upstream http.HandlerFunc, keys ...string) *gin.Engine {
+	t.Helper()
+
+	backend := httptest.NewServer(upstream)
+	t.Cleanup(backend.Close)
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{Port: 8080},
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 40,
+			APIKeys:   keys,
+			Timeout:   1,
+			Timeouts:  config.TimeoutsConfig{Connect: 1, FirstByte: 1, Idle: 1},
+			Retry:     config.RetryConfig{MaxRetries: 3, AutoFailover: true},
+		},
+	}
+
+	router := gin.New()
+	NewProxyServer(cfg).SetupRoutes(router)
+	return router
+}
+
+func TestChatCompletions_FirstByteTimeoutFailsOver(t *testing.T) {
+	router := newTimeoutTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer nvapi-hung-key-0001" {
+			// Consume the body so the server notices when the proxy hangs up
+			io.Copy(io.Discard, r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"id\":\"ok\"}\n\ndata: [DONE]\n\n"))
+	}, "nvapi-hung-key-0001", "nvapi-working-key-0002")
+
+	start := time.Now()
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m","stream":true}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"id":"ok"`) {
+		t.Fatalf("Expected failover to the working key, got %d %s", rec.Code, rec.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the hung key to be abandoned after the first byte timeout, took %s", elapsed)
+	}
+}
+
+func TestChatCompletions_StreamIdleTimeout(t *testing.T) {
+	router := newTimeoutTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"n\":1}\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}, "nvapi-key-0001")
+
+	start := time.Now()
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m","stream":true}`)
+	if !strings.Contains(rec.Body.String(), `{"n":1}`) {
+		t.Errorf("Expected the chunk sent before the stall, got %q", rec.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the stalled stream to be closed after the idle timeout, took %s", elapsed)
+	}
+}
+
+func TestChatCompletions_LongStreamOutlivesOverallTimeout(t *testing.T) {
+	router := newTimeoutTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 15; i++ {
+			w.Write([]byte("data: {\"n\":" + strconv.Itoa(i) + "}\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	}, "nvapi-key-0001")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m","stream":true}`)
+	if !strings.Contains(rec.Body.String(), "[DONE]") {
+		t.Errorf("Expected a steadily streaming response to run past the overall timeout, got %q", rec.Body.String())
+	}
+}
+
+// usageStream answers a streaming chat completion, sending a final usage
+// chunk only when the request asked for it
+func usageStream(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			StreamOptions struct {
+				IncludeUsage bool `json:"include_usage"`
+			} `json:"stream_options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		if !body.StreamOptions.IncludeUsage {
+			t.Error("Expected the proxy to request usage for the stream")
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}],\"usage\":null}\n\n"))
+		w.Write([]byte("data: {\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":3,\"total_tokens\":10}}\n\n"))
+		w.Write([]byte("data: [DONE]\n\n"))
+	}
+}
+
+func TestChatCompletions_StreamUsageHiddenFromClient(t *testing.T) {
+	router, lb := newTestServer(t, usageStream(t), "nvapi-key-0001")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m","stream":true}`)
+	body := rec.Body.String()
+	if strings.Contains(body, "usage") {
+		t.Errorf("Expected usage the client did not ask for to be stripped, got %q", body)
+	}
+	if !strings.Contains(body, `"content":"hi"`) || !strings.Contains(body, "[DONE]") {
+		t.Errorf("Expected the content chunks to be forwarded, got %q", body)
+	}
+
+	stats := lb.GetStats()
+	if stats[0].PromptTokens != 7 || stats[0].CompletionTokens != 3 {
+		t.Errorf("Expected usage to be charged to the key, got %+v", stats[0])
+	}
+
+	var response struct {
+		Models map[string]ModelUsage `json:"models"`
+	}
+	if err := json.Unmarshal(serveAdmin(router, "GET", "/stats").Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if got := response.Models["m"]; got.Requests != 1 || got.TotalTokens != 10 {
+		t.Errorf("Unexpected model usage: %+v", got)
+	}
+}
+
+func TestChatCompletions_StreamUsagePassedThroughWhenRequested(t *testing.T) {
+	router, lb := newTestServer(t, usageStream(t), "nvapi-key-0001")
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m","stream":true,"stream_options":{"include_usage":true}}`)
+	if !strings.Contains(rec.Body.String(), `"prompt_tokens":7`) {
+		t.Errorf("Expected requested usage to reach the client, got %q", rec.Body.String())
+	}
+	if stats := lb.GetStats(); stats[0].PromptTokens != 7 {
+		t.Errorf("Expected usage to be charged to the key, got %+v", stats[0])
+	}
+}
+
+func TestChatCompletions_UsageFromGzippedResponse(t *testing.T) {
+	router, lb := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write([]byte(`{"id":"ok","usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`))
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"id":"ok","usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`))
+		gz.Close()
+	}, "nvapi-key-0001")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[]}`))
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"id":"ok"`) {
+		t.Errorf("Expected a decompressed body, got %q", rec.Body.String())
+	}
+	if stats := lb.GetStats(); stats[0].PromptTokens != 7 || stats[0].CompletionTokens != 3 {
+		t.Errorf("Expected usage to be charged to the key, got %+v", stats[0])
+	}
+}
+
+func TestChatCompletions_SettlesReservedTokens(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"ok","usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}))
+	defer backend.Close()
+
+	ps := NewProxyServer(&config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:         backend.URL,
+			RateLimit:       40,
+			TokensPerMinute: 1000,
+			APIKeys:         []string{"nvapi-key-0001"},
+			Timeout:         5,
+		},
+	})
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	rec := serve(router, "POST", "/v1/chat/completions", `{"model":"m","max_tokens":800,"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+
+	// The 800 token reservation is replaced by the 15 tokens actually used
+	stats := ps.current().upstreams["nvidia"].loadBalancer.GetStats()
+	if stats[0].AvailableTPM != 985 {
+		t.Errorf("Expected 985 tokens left after settling, got %d", stats[0].AvailableTPM)
+	}
+
+	// A request the budget cannot cover waits for it to refill
+	start := time.Now()
+	rec = serve(router, "POST", "/v1/chat/completions", `{"model":"m","max_tokens":1000}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Expected the request to wait for the token budget, took %s", elapsed)
+	}
+}
+
+func TestProxyServer_RestoresStateAfterRestart(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"ok"}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 40,
+			APIKeys:   []string{"nvapi-key-0001"},
+			Timeout:   5,
+		},
+		State: config.StateConfig{Path: t.TempDir() + "/state.json", Interval: 30},
+	}
+
+	ps := NewProxyServer(cfg)
+	router := gin.New()
+	ps.SetupRoutes(router)
+	for i := 0; i < 3; i++ {
+		serve(router, "POST", "/v1/chat/completions", `{"model":"m"}`)
+	}
+	if err := ps.SaveState(); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	restarted := NewProxyServer(cfg)
+	stats := restarted.current().upstreams["nvidia"].loadBalancer.GetStats()
+	if stats[0].RequestCount != 3 || stats[0].AvailableTokens != 37 {
+		t.Errorf("Expected key state to survive a restart, got %+v", stats[0])
+	}
+}
+
+func TestChatCompletions_SessionAffinity(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]map[string]bool) // session -> keys used
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		session := r.Header.Get("X-Session-ID")
+		if seen[session] == nil {
+			seen[session] = make(map[string]bool)
+		}
+		seen[session][r.Header.Get("Authorization")] = true
+		mu.Unlock()
+		w.Write([]byte(`{"id":"ok"}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 40,
+			APIKeys:   []string{"nvapi-key-0001", "nvapi-key-0002", "nvapi-key-0003"},
+			Timeout:   5,
+			Affinity:  config.AffinityConfig{By: []string{config.AffinityHeader}, Header: "X-Session-ID"},
+		},
+	}
+	ps := NewProxyServer(cfg)
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	for i := 0; i < 4; i++ {
+		for _, session := range []string{"a", "b", "c"} {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+			req.Header.Set("X-Session-ID", session)
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", rec.Code)
+			}
+		}
+	}
+
+	for session, keys := range seen {
+		if len(keys) != 1 {
+			t.Errorf("Expected session %s to stick to one key, got %v", session, keys)
+		}
+	}
+}
+
+func TestAffinityKey_Messages(t *testing.T) {
+	cfg := config.AffinityConfig{By: []string{config.AffinityHeader, config.AffinityMessages}, Header: "X-Session-ID"}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	parse := func(body string) map[string]interface{} {
+		var reqBody map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &reqBody); err != nil {
+			t.Fatal(err)
+		}
+		return reqBody
+	}
+
+	// Later turns repeat the system prompt and first user message
+	first := affinityKey(c, cfg, parse(`{"messages":[{"role":"system","content":"s"},{"role":"user","content":"hi"}]}`))
+	second := affinityKey(c, cfg, parse(`{"messages":[{"role":"system","content":"s"},{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"more"}]}`))
+	other := affinityKey(c, cfg, parse(`{"messages":[{"role":"user","content":"bye"}]}`))
+
+	if first == "" || first != second {
+		t.Errorf("Expected turns of a conversation to share an affinity, got %q and %q", first, second)
+	}
+	if other == first {
+		t.Errorf("Expected another conversation to get another affinity")
+	}
+
+	// The header wins when present
+	c.Request.Header.Set("X-Session-ID", "abc")
+	if got := affinityKey(c, cfg, parse(`{"messages":[]}`)); got != "header:abc" {
+		t.Errorf("Expected header:abc, got %q", got)
+	}
+}
+
+func TestChatCompletions_ModelWithoutKey(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"ok"}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 40,
+			Keys:      []config.KeyConfig{{Key: "nvapi-key-0001", Models: []string{"meta/*"}}},
+			Timeout:   5,
+		},
+	}
+	ps := NewProxyServer(cfg)
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	if rec := serve(router, "POST", "/v1/chat/completions", `{"model":"meta/llama-3.1-8b-instruct"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a served model, got %d", rec.Code)
+	}
+	if rec := serve(router, "POST", "/v1/chat/completions", `{"model":"mistralai/mixtral-8x22b"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a model no key serves, got %d", rec.Code)
+	}
+}
+
+func TestChatCompletions_ClientLimits(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-User") == "slow" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(`{"id":"ok"}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 100,
+			APIKeys:   []string{"nvapi-key-0001"},
+			Timeout:   5,
+		},
+		ClientLimits: config.ClientLimitsConfig{
+			By:                config.ClientByHeader,
+			Header:            "X-User",
+			RequestsPerMinute: 2,
+			MaxConcurrency:    1,
+		},
+	}
+	ps := NewProxyServer(cfg)
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	send := func(user string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		req.Header.Set("X-User", user)
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("alice")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-RateLimit-Limit") != "2" || rec.Header().Get("X-RateLimit-Remaining") != "1" || rec.Header().Get("X-RateLimit-Reset") != "30" {
+		t.Errorf("Unexpected rate limit headers: %v", rec.Header())
+	}
+
+	send("alice")
+	rec = send("alice")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After once alice is out of requests, got %d", rec.Code)
+	}
+
+	// Other clients have budgets of their own
+	if rec := send("bob"); rec.Code != http.StatusOK {
+		t.Errorf("Expected bob to be unaffected, got %d", rec.Code)
+	}
+
+	// A client with a request in flight may not start another
+	done := make(chan struct{})
+	go func() {
+		send("slow")
+		close(done)
+	}()
+	<-arrived
+	rec = send("slow")
+	close(release)
+	<-done
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a second concurrent request, got %d", rec.Code)
+	}
+}
+
+func TestChatCompletions_ClientLimitsByKeyWithoutClients(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"ok"}`))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		NVIDIA: config.NVIDIAConfig{
+			BaseURL:   backend.URL,
+			RateLimit: 100,
+			APIKeys:   []string{"nvapi-key-0001"},
+			Timeout:   5,
+		},
+		ClientLimits: config.ClientLimitsConfig{By: config.ClientByKey, RequestsPerMinute: 1},
+	}
+	ps := NewProxyServer(cfg)
+	router := gin.New()
+	ps.SetupRoutes(router)
+
+	send := func(key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"m"}`))
+		req.Header.Set("Authorization", "Bearer "+key)
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("made-up-1"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	// Unchecked keys do not get a budget of their own
+	if rec := send("made-up-2"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 for a new key from the same IP, got %d", rec.Code)
+	}
+}
+
+func TestModelLabels(t *testing.T) {
+	cfg := &config.Config{
+		Fallbacks: map[string][]string{"big": {"small"}},
+	}
+	labels := newModelLabels()
+
+	if got := labels.label(cfg, "small", false); got != "small" {
+		t.Errorf("Expected a configured model to keep its label, got %q", got)
+	}
+	if got := labels.label(cfg, "made-up", false); got != otherModel {
+		t.Errorf("Expected an unknown model to be labelled %q, got %q", otherModel, got)
+	}
+	if got := labels.label(cfg, "served", true); got != "served" {
+		t.Errorf("Expected a served model to get its own label, got %q", got)
+	}
+	if got := labels.label(cfg, "served", false); got != "served" {
+		t.Errorf("Expected a model served before to keep its label, got %q", got)
+	}
+
+	for i := 0; i < maxModelLabels; i++ {
+		labels.label(cfg, "model-"+strconv.Itoa(i), true)
+	}
+	if got := labels.label(cfg, "one-too-many", true); got != otherModel {
+		t.Errorf("Expected labels to be capped, got %q", got)
+	}
+}
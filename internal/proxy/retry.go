@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+)
+
+const (
+	// retryBaseDelay is the backoff before the first retry, doubled for each
+	// further attempt
+	retryBaseDelay = 100 * time.Millisecond
+	// retryMaxDelay caps the backoff between attempts
+	retryMaxDelay = 2 * time.Second
+	// maxDrainBytes is how much of a discarded response we read so the
+	// connection can be reused
+	maxDrainBytes = 64 << 10
+)
+
+// upstreamError means the upstream could not be reached with any key
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("failed to contact upstream: %v", e.err)
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// dispatchChat sends a chat completion upstream. On 401 or 403 the request
+// moves on to the next key right away, and keys the upstream keeps rejecting
+// are quarantined; rate
+// limiting, server errors and connection errors are tried on up to
+// max_retries distinct keys with auto_failover, after a jittered backoff.
+// Nothing is written to the client here, so a transient key failure is never
+// visible: the returned response is either a success, a non-retryable error,
+// or the failure from the last attempt, together with the key it was sent
+// with. Unless wait is set, it fails right away instead of queueing when no
+// key is available; retries never queue, and return the last failure when no
+// other key is free. Keys are acquired with the given tokens and affinity, and
+// the estimated tokens stay reserved on the returned key until they are
+// settled.
+func (ps *ProxyServer) dispatchChat(c *gin.Context, up *upstream, body []byte, model string, acquire balancer.AcquireOptions, isStreaming, wait bool) (*http.Response, *balancer.APIKey, error) {
+	retry := up.config.Retry
+	attempts := 1
+	if retry.AutoFailover && retry.MaxRetries > 1 {
+		attempts = retry.MaxRetries
+	}
+
+	var tried []*balancer.APIKey
+	var lastErr error
+	var last *http.Response // failed response kept until another key is found
+	var lastKey *balancer.APIKey
+	failures := 0    // attempts that count against max_retries
+	backoff := false // whether the last attempt failed transiently
+	for {
+		if backoff {
+			select {
+			case <-time.After(retryBackoff(failures)):
+			case <-c.Request.Context().Done():
+				if last != nil {
+					up.discardAttempt(last, lastKey, acquire.Tokens)
+				}
+				return nil, nil, c.Request.Context().Err()
+			}
+		}
+
+		// Get API key from load balancer
+		acquire.Exclude, acquire.NoWait = tried, !wait || len(tried) > 0
+		apiKey, err := up.loadBalancer.Acquire(c.Request.Context(), acquire)
+		if err != nil {
+			if last != nil {
+				return last, lastKey, nil
+			}
+			if lastErr != nil {
+				return nil, nil, lastErr
+			}
+			return nil, nil, err
+		}
+		tried = append(tried, apiKey)
+		if last != nil {
+			up.discardAttempt(last, lastKey, acquire.Tokens)
+			last, lastKey = nil, nil
+		}
+
+		// Log request if enabled
+		if ps.Config().Logging.EnableRequestLog {
+			fmt.Printf("[%s] Request to model: %s, upstream: %s, streaming: %v, key: %s, attempt: %d\n",
+				time.Now().Format("2006-01-02 15:04:05"),
+				model,
+				up.name,
+				isStreaming,
+				balancer.MaskAPIKey(apiKey.Key),
+				len(tried))
+		}
+
+		canFailover := up.loadBalancer.CanFailover(tried, acquire.Model)
+		canRetry := canFailover && failures+1 < attempts
+
+		resp, err := ps.doChatRequest(c, up, body, apiKey, isStreaming)
+		if err != nil {
+			up.loadBalancer.Release(apiKey)
+			up.loadBalancer.SettleTokens(apiKey, acquire.Tokens, 0)
+
+			// The client went away, which says nothing about the key
+			if ctxErr := c.Request.Context().Err(); ctxErr != nil {
+				return nil, nil, ctxErr
+			}
+
+			up.loadBalancer.MarkKeyError(apiKey)
+			lastErr = &upstreamError{err: err}
+			if !canRetry {
+				break
+			}
+			failures++
+			backoff = true
+			continue
+		}
+
+		up.holdKey(resp, apiKey)
+
+		// A refused key says nothing about the others, so its request always
+		// moves on, however many retries are configured
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			if up.rejectedKey(apiKey, resp.StatusCode, acquire.Model) {
+				up.quarantineKey(apiKey, resp.StatusCode)
+			}
+			if !canFailover {
+				return resp, apiKey, nil
+			}
+			backoff = false
+		} else {
+			up.recordKeyOutcome(apiKey, resp.StatusCode)
+			if !canRetry || !isRetryable(resp.StatusCode) {
+				return resp, apiKey, nil
+			}
+			failures++
+			backoff = true
+		}
+
+		last, lastKey, lastErr = resp, apiKey, nil
+	}
+
+	return nil, nil, lastErr
+}
+
+// isRetryable reports whether another key might succeed where this one failed
+// for reasons other than the key being rejected
+func isRetryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryBackoff returns the jittered delay before the given retry attempt
+func retryBackoff(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+
+	// Wait between half and the full delay so concurrent retries spread out
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// discardAttempt drops the response of a failed attempt and gives back the
+// tokens reserved for it
+func (up *upstream) discardAttempt(resp *http.Response, key *balancer.APIKey, tokens int) {
+	discardResponse(resp)
+	up.loadBalancer.SettleTokens(key, tokens, 0)
+}
+
+// discardResponse drains and closes a response we are not going to forward
+func discardResponse(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+	resp.Body.Close()
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/luongndcoder/proxypal-nvidia/internal/state"
+)
+
+// loadState returns the key state saved by a previous run, per upstream. A
+// missing or unreadable state file starts every key fresh.
+func (ps *ProxyServer) loadState() map[string][]balancer.KeyState {
+	if ps.store == nil {
+		return nil
+	}
+
+	snapshot, err := ps.store.Load()
+	if err != nil {
+		fmt.Printf("Starting with fresh key state: %v\n", err)
+		return nil
+	}
+	return snapshot.Upstreams
+}
+
+// SaveState writes a snapshot of every key's limiter state, counters, quota
+// and quarantine to the state store, if one is configured
+func (ps *ProxyServer) SaveState() error {
+	if ps.store == nil {
+		return nil
+	}
+
+	snapshot := &state.Snapshot{
+		SavedAt:   time.Now(),
+		Upstreams: make(map[string][]balancer.KeyState),
+	}
+	for _, up := range ps.current().order {
+		snapshot.Upstreams[up.name] = up.loadBalancer.Snapshot()
+	}
+	return ps.store.Save(snapshot)
+}
+
+// PersistState saves the key state every state interval until the context
+// is done
+func (ps *ProxyServer) PersistState(ctx context.Context) {
+	if ps.store == nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(ps.Config().State.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ps.SaveState(); err != nil {
+				fmt.Printf("Failed to save key state: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+var (
+	// errFirstByteTimeout means a stream did not start in time
+	errFirstByteTimeout = errors.New("upstream did not start responding in time")
+	// errIdleTimeout means a stream went quiet for too long between chunks
+	errIdleTimeout = errors.New("upstream stream idle for too long")
+)
+
+// newHTTPClient creates the client used for requests to an upstream. The
+// client itself has no overall timeout: send applies the per-request ones.
+func newHTTPClient(cfg config.UpstreamConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if connect := seconds(cfg.Timeouts.Connect); connect > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   connect,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = connect
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// send performs a request against the upstream with the configured timeouts.
+// Streams get the first byte and idle timeouts, other requests are capped by
+// the overall timeout. Closing the returned body ends the request.
+func (up *upstream) send(req *http.Request, isStreaming bool) (*http.Response, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if total := seconds(up.config.Timeout); total > 0 && !isStreaming {
+		ctx, cancel = context.WithTimeout(req.Context(), total)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+
+	var firstByteExpired atomic.Bool
+	firstByte := seconds(up.config.Timeouts.FirstByte)
+	if isStreaming && firstByte > 0 {
+		timer := time.AfterFunc(firstByte, func() {
+			firstByteExpired.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	resp, err := up.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if firstByteExpired.Load() {
+			return nil, fmt.Errorf("%w after %s", errFirstByteTimeout, firstByte)
+		}
+		return nil, err
+	}
+
+	body := &timedBody{ReadCloser: resp.Body, cancel: cancel}
+	if idle := seconds(up.config.Timeouts.Idle); isStreaming && idle > 0 {
+		body.idle = idle
+		body.timer = time.AfterFunc(idle, func() {
+			body.expired.Store(true)
+			cancel()
+		})
+	}
+	resp.Body = body
+
+	return resp, nil
+}
+
+// timedBody cancels its request when closed and, for streams, when no data
+// arrived within the idle timeout
+type timedBody struct {
+	io.ReadCloser
+	cancel  context.CancelFunc
+	idle    time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.timer != nil && !b.expired.Load() {
+		b.timer.Reset(b.idle)
+	}
+	if err != nil && b.expired.Load() {
+		err = fmt.Errorf("%w (%s)", errIdleTimeout, b.idle)
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// seconds converts a timeout from the configuration
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// upstream is an OpenAI-compatible API with its own key pool
+type upstream struct {
+	name         string
+	config       *config.UpstreamConfig
+	loadBalancer *balancer.LoadBalancer
+	httpClient   *http.Client
+}
+
+// newUpstream creates an upstream and the load balancer for its keys,
+// restoring any saved key state
+func newUpstream(cfg config.UpstreamConfig, saved []balancer.KeyState) *upstream {
+	return &upstream{
+		name:         cfg.Name,
+		config:       &cfg,
+		loadBalancer: balancer.NewLoadBalancer(&cfg, saved...),
+		httpClient:   newHTTPClient(cfg),
+	}
+}
+
+// reload returns the upstream with new settings. The load balancer is kept
+// so keys that are still configured keep their state, and so is the HTTP
+// client with its pooled connections unless the connect timeout changed.
+func (up *upstream) reload(cfg config.UpstreamConfig) *upstream {
+	up.loadBalancer.Reload(&cfg)
+
+	httpClient := up.httpClient
+	if cfg.Timeouts.Connect != up.config.Timeouts.Connect {
+		httpClient = newHTTPClient(cfg)
+		up.httpClient.CloseIdleConnections()
+	}
+
+	return &upstream{
+		name:         cfg.Name,
+		config:       &cfg,
+		loadBalancer: up.loadBalancer,
+		httpClient:   httpClient,
+	}
+}
+
+// holdKey keeps the key counted as in flight until the response body is
+// closed, so a key removed by a reload is not dropped mid-stream
+func (up *upstream) holdKey(resp *http.Response, key *balancer.APIKey) {
+	resp.Body = &keyReleasingBody{
+		ReadCloser: resp.Body,
+		release:    func() { up.loadBalancer.Release(key) },
+	}
+}
+
+// keyReleasingBody releases an API key the first time it is closed
+type keyReleasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *keyReleasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// quarantineKey takes a key the upstream rejected out of rotation
+func (up *upstream) quarantineKey(key *balancer.APIKey, statusCode int) {
+	reason := fmt.Sprintf("upstream returned %d %s", statusCode, http.StatusText(statusCode))
+	up.loadBalancer.DisableKey(key, reason)
+	fmt.Printf("[%s] Disabled key %s on %s: %s\n",
+		time.Now().Format("2006-01-02 15:04:05"),
+		balancer.MaskAPIKey(key.Key),
+		up.name,
+		reason)
+}
+
+// recordKeyOutcome reports an upstream status code to the key's circuit
+// breaker. Rate limiting and server errors count as failures; refusals are
+// left to rejectedKey; anything else means the key itself is working.
+func (up *upstream) recordKeyOutcome(key *balancer.APIKey, statusCode int) {
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return
+	}
+	if statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError {
+		up.loadBalancer.MarkKeyError(key)
+		return
+	}
+	up.loadBalancer.MarkKeySuccess(key)
+}
+
+// rejectedKey reports whether the upstream rejected the key itself: always
+// on 401, and on 403 once the key was refused several times in a row. A
+// single 403 may just mean the key has no access to the model, so the
+// request moves on to another key without giving up on this one yet.
+func (up *upstream) rejectedKey(key *balancer.APIKey, statusCode int, model string) bool {
+	switch statusCode {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		return up.loadBalancer.MarkForbidden(key, model)
+	}
+	return false
+}
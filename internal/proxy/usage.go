@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// Usage is the token usage reported by the upstream
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// parseUsage extracts usage from a chat completion body or a single SSE chunk
+func parseUsage(data []byte) (Usage, bool) {
+	// Cheap check before paying for a full decode of every chunk
+	if !bytes.Contains(data, []byte(`"usage"`)) {
+		return Usage{}, false
+	}
+
+	var body struct {
+		Usage *Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil || body.Usage == nil {
+		return Usage{}, false
+	}
+
+	usage := *body.Usage
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage, true
+}
+
+// sseData returns the payload of an SSE "data:" line
+func sseData(line []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return nil, false
+	}
+	return bytes.TrimSpace(line[len("data:"):]), true
+}
+
+// requestStreamUsage asks upstream to report usage at the end of a stream by
+// setting stream_options.include_usage. It returns false when the client had
+// already asked for usage itself, in which case it must be passed through.
+func requestStreamUsage(reqBody map[string]interface{}) bool {
+	options, _ := reqBody["stream_options"].(map[string]interface{})
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	if include, _ := options["include_usage"].(bool); include {
+		return false
+	}
+
+	options["include_usage"] = true
+	reqBody["stream_options"] = options
+	return true
+}
+
+// stripUsage removes usage the client did not ask for from an SSE chunk. The
+// dedicated usage chunk sent at the end of a stream is dropped entirely.
+func stripUsage(data []byte) (chunk []byte, keep bool) {
+	if !bytes.Contains(data, []byte(`"usage"`)) {
+		return data, true
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data, &body); err != nil {
+		return data, true
+	}
+	var choices []json.RawMessage
+	if err := json.Unmarshal(body["choices"], &choices); err == nil && len(choices) == 0 {
+		return nil, false
+	}
+
+	delete(body, "usage")
+	stripped, err := json.Marshal(body)
+	if err != nil {
+		return data, true
+	}
+	return stripped, true
+}
+
+// ModelUsage is the token usage accumulated for a model
+type ModelUsage struct {
+	Requests         uint64 `json:"requests"`
+	PromptTokens     uint64 `json:"prompt_tokens"`
+	CompletionTokens uint64 `json:"completion_tokens"`
+	TotalTokens      uint64 `json:"total_tokens"`
+}
+
+// usageTracker accumulates token usage per serving model
+type usageTracker struct {
+	mu     sync.Mutex
+	models map[string]*ModelUsage
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{models: make(map[string]*ModelUsage)}
+}
+
+// record adds the usage of one request to a model
+func (ut *usageTracker) record(model string, usage Usage) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	m, ok := ut.models[model]
+	if !ok {
+		m = &ModelUsage{}
+		ut.models[model] = m
+	}
+	m.Requests++
+	m.PromptTokens += uint64(usage.PromptTokens)
+	m.CompletionTokens += uint64(usage.CompletionTokens)
+	m.TotalTokens += uint64(usage.TotalTokens)
+}
+
+// stats returns a copy of the usage per model
+func (ut *usageTracker) stats() map[string]ModelUsage {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+
+	stats := make(map[string]ModelUsage, len(ut.models))
+	for model, m := range ut.models {
+		stats[model] = *m
+	}
+	return stats
+}
+
+// maxModelLabels bounds the models that get a metrics label of their own
+// without being named in the configuration
+const maxModelLabels = 200
+
+// otherModel labels the metrics of every other model
+const otherModel = "other"
+
+// modelLabels keeps the model labels of metrics bounded. Clients may send any
+// model name, so a model only gets a label of its own when the configuration
+// names it or an upstream served it.
+type modelLabels struct {
+	mu     sync.Mutex
+	served map[string]bool
+}
+
+func newModelLabels() *modelLabels {
+	return &modelLabels{served: make(map[string]bool)}
+}
+
+// label returns the label for a model, remembering it once served
+func (ml *modelLabels) label(cfg *config.Config, model string, served bool) string {
+	if cfg.NamesModel(model) {
+		return model
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if !ml.served[model] {
+		if !served || len(ml.served) >= maxModelLabels {
+			return otherModel
+		}
+		ml.served[model] = true
+	}
+	return model
+}
+
+// charsPerToken is a rough average used to estimate prompt tokens before the
+// upstream has counted them
+const charsPerToken = 4
+
+// estimateTokens guesses the tokens a chat completion will use: the completion
+// limit the client set plus the size of the messages. Without max_tokens only
+// the prompt is counted; the estimate is corrected with the reported usage.
+func estimateTokens(reqBody map[string]interface{}) int {
+	tokens := 0
+	for _, field := range []string{"max_completion_tokens", "max_tokens"} {
+		if n, ok := reqBody[field].(float64); ok && n > 0 {
+			tokens = int(n)
+			break
+		}
+	}
+
+	if messages, err := json.Marshal(reqBody["messages"]); err == nil {
+		tokens += len(messages) / charsPerToken
+	}
+	return tokens
+}
@@ -0,0 +1,90 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+// Snapshot is the key state of every upstream at a point in time
+type Snapshot struct {
+	SavedAt   time.Time                      `json:"saved_at"`
+	Upstreams map[string][]balancer.KeyState `json:"upstreams"`
+}
+
+// Store persists snapshots across restarts
+type Store interface {
+	// Load returns the last saved snapshot, or an empty one if none was saved
+	Load() (*Snapshot, error)
+	// Save replaces the saved snapshot
+	Save(snapshot *Snapshot) error
+}
+
+// Open returns the store described by the configuration, or nil when state
+// is not persisted
+func Open(cfg config.StateConfig) Store {
+	if cfg.Path == "" {
+		return nil
+	}
+	return NewFileStore(cfg.Path)
+}
+
+// FileStore keeps the snapshot in a JSON file
+type FileStore struct {
+	path string
+}
+
+// NewFileStore creates a store backed by the file at path
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load implements Store
+func (fs *FileStore) Load() (*Snapshot, error) {
+	data, err := os.ReadFile(fs.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// Save implements Store. The file is replaced atomically so a crash while
+// saving never leaves a truncated snapshot behind.
+func (fs *FileStore) Save(snapshot *Snapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/luongndcoder/proxypal-nvidia/internal/balancer"
+	"github.com/luongndcoder/proxypal-nvidia/internal/config"
+)
+
+func TestFileStore_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store := NewFileStore(path)
+
+	saved := &Snapshot{
+		SavedAt: time.Now().Truncate(time.Second),
+		Upstreams: map[string][]balancer.KeyState{
+			"nvidia": {{KeyHash: "abc", RequestCount: 42, Disabled: true}},
+		},
+	}
+	if err := store.Save(saved); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	keys := loaded.Upstreams["nvidia"]
+	if len(keys) != 1 || keys[0].RequestCount != 42 || !keys[0].Disabled {
+		t.Errorf("Unexpected snapshot: %+v", loaded)
+	}
+	if !loaded.SavedAt.Equal(saved.SavedAt) {
+		t.Errorf("Expected saved time %s, got %s", saved.SavedAt, loaded.SavedAt)
+	}
+
+	// Nothing but the state file is left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected only the state file, got %d files", len(entries))
+	}
+}
+
+func TestFileStore_LoadMissing(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "missing.json"))
+
+	snapshot, err := store.Load()
+	if err != nil {
+		t.Fatalf("Expected no error for a missing file, got %v", err)
+	}
+	if len(snapshot.Upstreams) != 0 {
+		t.Errorf("Expected an empty snapshot, got %+v", snapshot)
+	}
+}
+
+func TestFileStore_LoadCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte("{not json"), 0o600)
+
+	if _, err := NewFileStore(path).Load(); err == nil {
+		t.Error("Expected an error for a corrupt state file")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if Open(config.StateConfig{}) != nil {
+		t.Error("Expected no store without a path")
+	}
+	if Open(config.StateConfig{Path: "state.json", Interval: 30}) == nil {
+		t.Error("Expected a file store with a path")
+	}
+}
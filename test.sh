@@ -3,6 +3,7 @@
 # Test script for ProxyPal NVIDIA Load Balancer
 
 BASE_URL="http://localhost:8080"
+ADMIN_TOKEN="${ADMIN_TOKEN:-}"
 
 echo "=================================================="
 echo "ProxyPal NVIDIA Load Balancer - Test Suite"
@@ -19,7 +20,7 @@ echo ""
 # Test 2: Statistics
 echo "Test 2: Statistics"
 echo "------------------"
-curl -s "${BASE_URL}/stats" | jq '.' || echo "Error: Failed to get stats"
+curl -s "${BASE_URL}/stats" -H "X-Admin-Token: ${ADMIN_TOKEN}" | jq '.' || echo "Error: Failed to get stats"
 echo ""
 echo ""
 
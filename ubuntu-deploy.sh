@@ -208,7 +208,7 @@ if $COMPOSE_CMD ps | grep -q "Up"; then
     echo ""
     echo "Next steps:"
     echo "  1. Test: curl http://localhost:8080/health"
-    echo "  2. View stats: curl http://localhost:8080/stats"
+    echo "  2. View stats: curl http://localhost:8080/stats -H \"X-Admin-Token: \$ADMIN_TOKEN\""
     echo "  3. Use with OpenAI client library"
     echo ""
     echo "Documentation: See README.md and UBUNTU_DEPLOY.md"
@@ -45,11 +45,11 @@ echo ""
 
 # Check stats endpoint
 echo "3. Checking stats endpoint..."
-if curl -s http://localhost:8080/stats > /dev/null 2>&1; then
+if curl -s http://localhost:8080/stats -H "X-Admin-Token: ${ADMIN_TOKEN}" > /dev/null 2>&1; then
     echo "✅ Stats endpoint is accessible"
     if command -v jq &> /dev/null; then
         echo "   Stats:"
-        curl -s http://localhost:8080/stats | jq '.stats[] | {KeyPrefix, RequestCount, AvailableTokens}'
+        curl -s http://localhost:8080/stats -H "X-Admin-Token: ${ADMIN_TOKEN}" | jq '.stats[] | {KeyPrefix, RequestCount, AvailableTokens}'
     fi
 else
     echo "❌ Stats endpoint failed"